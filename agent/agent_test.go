@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/otard95/pass-env/state"
+)
+
+func startAgent(t *testing.T, idleTimeout time.Duration) chan error {
+	t.Helper()
+
+	if err := supported(); err != nil {
+		t.Skip(err)
+	}
+	t.Setenv("PASS_ENV_AGENT_SOCK", filepath.Join(t.TempDir(), "agent.sock"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Serve(ctx, idleTimeout) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for range 100 {
+		if Running() {
+			return done
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("agent did not start")
+	return nil
+}
+
+func TestAgentNotRunning(t *testing.T) {
+	t.Setenv("PASS_ENV_AGENT_SOCK", filepath.Join(t.TempDir(), "agent.sock"))
+
+	if Running() {
+		t.Fatal("Expected no agent")
+	}
+	if _, _, err := Get("abc"); err != ErrNotRunning {
+		t.Errorf("Expected ErrNotRunning, got %v", err)
+	}
+}
+
+func TestAgentSetGetClear(t *testing.T) {
+	startAgent(t, 0)
+
+	entry := state.NewCacheEntry(map[string]string{"TOKEN": "secret"}, nil)
+	entry.PassNames = []string{"github/token"}
+	if err := Set("abc", entry); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	got, hit, err := Get("abc")
+	if err != nil || !hit {
+		t.Fatalf("Expected hit, got %v %v", hit, err)
+	}
+	if got.Values["TOKEN"] != "secret" {
+		t.Errorf("Expected TOKEN=secret, got %v", got.Values)
+	}
+
+	if _, hit, _ := Get("missing"); hit {
+		t.Error("Expected miss for unknown hash")
+	}
+
+	cleared, err := Clear(state.CacheSelector{PassNames: []string{"github/"}}, true)
+	if err != nil || len(cleared) != 1 {
+		t.Fatalf("Expected dry run to select 1 entry, got %v %v", cleared, err)
+	}
+	if _, hit, _ := Get("abc"); !hit {
+		t.Error("Expected dry run to keep the entry")
+	}
+
+	cleared, err = Clear(state.CacheSelector{PassNames: []string{"github/"}}, false)
+	if err != nil || len(cleared) != 1 || cleared[0].Hash != "abc" {
+		t.Fatalf("Expected to clear abc, got %v %v", cleared, err)
+	}
+	if _, hit, _ := Get("abc"); hit {
+		t.Error("Expected miss after clear")
+	}
+}
+
+func TestAgentDropsExpired(t *testing.T) {
+	startAgent(t, 0)
+
+	entry := state.NewCacheEntry(map[string]string{"TOKEN": "secret"}, nil)
+	entry.Created = time.Now().Add(-time.Hour)
+	entry.TTL = time.Minute
+	if err := Set("abc", entry); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	if _, hit, _ := Get("abc"); hit {
+		t.Error("Expected expired entry to be a miss")
+	}
+}
+
+func TestAgentStop(t *testing.T) {
+	done := startAgent(t, 0)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve failed: %v", err)
+		}
+		done <- nil
+	case <-time.After(time.Second):
+		t.Fatal("agent did not stop")
+	}
+	if Running() {
+		t.Error("Expected agent to be gone")
+	}
+}
+
+func TestAgentIdleTimeout(t *testing.T) {
+	done := startAgent(t, 200*time.Millisecond)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve failed: %v", err)
+		}
+		done <- nil
+	case <-time.After(2 * time.Second):
+		t.Fatal("agent did not idle out")
+	}
+}
+
+func TestServerMetadataHoldsNoValues(t *testing.T) {
+	if err := supported(); err != nil {
+		t.Skip(err)
+	}
+	s := &server{entries: make(map[string]heldEntry)}
+	defer s.wipe()
+
+	entry := state.NewCacheEntry(map[string]string{"TOKEN": "secret"}, nil)
+	if err := s.set("abc", entry); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if value, ok := s.entries["abc"].meta.Values["TOKEN"]; !ok || value != "" {
+		t.Errorf("Expected metadata to name TOKEN without its value, got %q", value)
+	}
+
+	cleared := s.clear(state.CacheSelector{Vars: []string{"TOKEN"}}, true)
+	if len(cleared) != 1 || cleared[0].Hash != "abc" {
+		t.Errorf("Expected to select abc by variable, got %v", cleared)
+	}
+	if got, hit := s.get("abc"); !hit || got.Values["TOKEN"] != "secret" {
+		t.Errorf("Expected the held entry to keep its value, got %v", got)
+	}
+}
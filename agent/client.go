@@ -0,0 +1,133 @@
+// Package agent keeps decrypted cache entries in the memory of a long
+// running process, served to the same user over a Unix socket, so a cache hit
+// needs neither gpg nor the disk.
+package agent
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/otard95/pass-env/state"
+)
+
+// ErrNotRunning is returned by the client functions when no agent is
+// listening on the socket
+var ErrNotRunning = errors.New("the pass-env agent is not running")
+
+// How long the client waits for the agent before giving up on it
+const clientTimeout = 2 * time.Second
+
+const (
+	opPing  = "ping"
+	opGet   = "get"
+	opSet   = "set"
+	opClear = "clear"
+	opStop  = "stop"
+)
+
+type request struct {
+	Op       string
+	Hash     string
+	Entry    *state.CacheEntry
+	Selector state.CacheSelector
+	DryRun   bool
+}
+
+type response struct {
+	Err   string
+	Hit   bool
+	Entry *state.CacheEntry
+	// The entries a clear removed, or would remove
+	Cleared []state.CacheSelection
+}
+
+// SocketPath returns the path of the agent's socket, $PASS_ENV_AGENT_SOCK or
+// pass-env/agent.sock in $XDG_RUNTIME_DIR
+func SocketPath() (string, error) {
+	if sock := os.Getenv("PASS_ENV_AGENT_SOCK"); sock != "" {
+		return sock, nil
+	}
+
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return "", errors.New("XDG_RUNTIME_DIR is not set")
+	}
+	return filepath.Join(runtimeDir, "pass-env", "agent.sock"), nil
+}
+
+func call(req request) (*response, error) {
+	sock, err := SocketPath()
+	if err != nil {
+		return nil, ErrNotRunning
+	}
+
+	conn, err := net.DialTimeout("unix", sock, clientTimeout)
+	if err != nil {
+		return nil, ErrNotRunning
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clientTimeout))
+
+	err = gob.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to the agent: %s", err)
+	}
+
+	res := &response{}
+	err = gob.NewDecoder(conn).Decode(res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from the agent: %s", err)
+	}
+	if res.Err != "" {
+		return nil, errors.New(res.Err)
+	}
+
+	return res, nil
+}
+
+// Running reports whether an agent answers on the socket
+func Running() bool {
+	_, err := call(request{Op: opPing})
+	return err == nil
+}
+
+// Get returns the entry the agent holds for hash, and a boolean indicating
+// a hit
+func Get(hash string) (*state.CacheEntry, bool, error) {
+	res, err := call(request{Op: opGet, Hash: hash})
+	if err != nil {
+		return nil, false, err
+	}
+	return res.Entry, res.Hit, nil
+}
+
+// Set hands entry to the agent to hold under hash, replacing any existing
+// entry
+func Set(hash string, entry *state.CacheEntry) error {
+	if entry.Created.IsZero() {
+		entry.Created = time.Now()
+	}
+	_, err := call(request{Op: opSet, Hash: hash, Entry: entry})
+	return err
+}
+
+// Clear removes the entries sel picks from the agent, or only reports them
+// with dryRun
+func Clear(sel state.CacheSelector, dryRun bool) ([]state.CacheSelection, error) {
+	res, err := call(request{Op: opClear, Selector: sel, DryRun: dryRun})
+	if err != nil {
+		return nil, err
+	}
+	return res.Cleared, nil
+}
+
+// Stop asks the agent to forget its entries and exit
+func Stop() error {
+	_, err := call(request{Op: opStop})
+	return err
+}
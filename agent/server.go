@@ -0,0 +1,278 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otard95/pass-env/state"
+)
+
+// server holds the entries, each gob-encoded into its own locked buffer
+type server struct {
+	mu      sync.Mutex
+	entries map[string]heldEntry
+	active  chan struct{}
+	stop    context.CancelFunc
+}
+
+// heldEntry is an entry's locked buffer, next to a copy of the entry without
+// its values, so expiring and selecting entries never decodes a secret
+type heldEntry struct {
+	data []byte
+	meta *state.CacheEntry
+}
+
+// Serve runs the agent on its socket until ctx is done, it is asked to stop,
+// or nothing has asked it anything for idleTimeout. A zero idleTimeout means
+// it never idles out. The entries are wiped before it returns.
+func Serve(ctx context.Context, idleTimeout time.Duration) error {
+	err := supported()
+	if err != nil {
+		return err
+	}
+
+	sock, err := SocketPath()
+	if err != nil {
+		return fmt.Errorf("no socket path for the agent: %s", err)
+	}
+
+	listener, err := listen(sock)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sock)
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	s := &server{
+		entries: make(map[string]heldEntry),
+		active:  make(chan struct{}, 1),
+		stop:    stop,
+	}
+	defer s.wipe()
+
+	go func() {
+		s.watchIdle(ctx, idleTimeout)
+		stop()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("agent stopped accepting connections: %s", err)
+		}
+
+		select {
+		case s.active <- struct{}{}:
+		default:
+		}
+		go s.handle(conn)
+	}
+}
+
+// listen creates the socket, readable by nobody but the user, after making
+// sure no other agent is using it
+func listen(sock string) (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(sock), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %s", err)
+	}
+
+	if Running() {
+		return nil, fmt.Errorf("an agent is already listening on '%s'", sock)
+	}
+	err = os.Remove(sock)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket '%s': %s", sock, err)
+	}
+
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on '%s': %s", sock, err)
+	}
+
+	err = os.Chmod(sock, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict socket permissions: %s", err)
+	}
+
+	return listener, nil
+}
+
+// watchIdle returns once ctx is done, or no connection has been accepted for
+// idleTimeout
+func (s *server) watchIdle(ctx context.Context, idleTimeout time.Duration) {
+	if idleTimeout <= 0 {
+		<-ctx.Done()
+		return
+	}
+
+	timer := time.NewTimer(idleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			return
+		case <-s.active:
+			timer.Reset(idleTimeout)
+		}
+	}
+}
+
+func (s *server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clientTimeout))
+
+	uid, err := peerUID(conn)
+	if err != nil || uid != os.Getuid() {
+		log.Printf("Refused connection from uid %d: %v", uid, err)
+		return
+	}
+
+	req := request{}
+	err = gob.NewDecoder(conn).Decode(&req)
+	if err != nil {
+		return
+	}
+
+	res := s.serve(req)
+	gob.NewEncoder(conn).Encode(res)
+
+	if req.Op == opStop {
+		s.stop()
+	}
+}
+
+func (s *server) serve(req request) *response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dropExpired()
+
+	res := &response{}
+	switch req.Op {
+	case opPing, opStop:
+	case opGet:
+		res.Entry, res.Hit = s.get(req.Hash)
+	case opSet:
+		err := s.set(req.Hash, req.Entry)
+		if err != nil {
+			res.Err = err.Error()
+		}
+	case opClear:
+		res.Cleared = s.clear(req.Selector, req.DryRun)
+	default:
+		res.Err = fmt.Sprintf("unknown agent request '%s'", req.Op)
+	}
+	return res
+}
+
+func (s *server) get(hash string) (*state.CacheEntry, bool) {
+	held, exists := s.entries[hash]
+	if !exists {
+		return nil, false
+	}
+
+	entry := &state.CacheEntry{}
+	err := gob.NewDecoder(bytes.NewReader(held.data)).Decode(entry)
+	if err != nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (s *server) set(hash string, entry *state.CacheEntry) error {
+	if entry == nil {
+		return errors.New("no entry to hold")
+	}
+
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode entry: %s", err)
+	}
+	defer clear(buffer.Bytes())
+
+	data, err := lockedCopy(buffer.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to lock entry in memory: %s", err)
+	}
+
+	s.remove(hash)
+	s.entries[hash] = heldEntry{data: data, meta: withoutValues(entry)}
+	return nil
+}
+
+// withoutValues copies entry, keeping the names of its values but not the
+// values themselves
+func withoutValues(entry *state.CacheEntry) *state.CacheEntry {
+	meta := *entry
+	meta.Values = make(map[string]string, len(entry.Values))
+	for name := range entry.Values {
+		meta.Values[name] = ""
+	}
+	return &meta
+}
+
+func (s *server) clear(sel state.CacheSelector, dryRun bool) []state.CacheSelection {
+	var cleared []state.CacheSelection
+	for hash, held := range s.entries {
+		if !sel.Matches(hash, held.meta) {
+			continue
+		}
+		cleared = append(cleared, state.CacheSelection{Hash: hash, PassNames: held.meta.PassNames})
+		if !dryRun {
+			s.remove(hash)
+		}
+	}
+
+	slices.SortFunc(cleared, func(a, b state.CacheSelection) int {
+		return strings.Compare(a.Hash, b.Hash)
+	})
+	return cleared
+}
+
+func (s *server) dropExpired() {
+	now := time.Now()
+	for hash, held := range s.entries {
+		if held.meta.Expired(now) {
+			s.remove(hash)
+		}
+	}
+}
+
+func (s *server) remove(hash string) {
+	if held, exists := s.entries[hash]; exists {
+		release(held.data)
+		delete(s.entries, hash)
+	}
+}
+
+func (s *server) wipe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash := range s.entries {
+		s.remove(hash)
+	}
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func supported() error {
+	return nil
+}
+
+// peerUID returns the uid of the process on the other end of conn, as
+// vouched for by the kernel
+func peerUID(conn net.Conn) (int, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return -1, fmt.Errorf("not a unix socket connection")
+	}
+
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return -1, err
+	}
+	if credErr != nil {
+		return -1, credErr
+	}
+
+	return int(cred.Uid), nil
+}
+
+// lockedCopy copies data into memory of its own that is never swapped out or
+// included in core dumps
+func lockedCopy(data []byte) ([]byte, error) {
+	buffer, err := unix.Mmap(-1, 0, max(len(data), 1), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+
+	err = unix.Mlock(buffer)
+	if err != nil {
+		unix.Munmap(buffer)
+		return nil, err
+	}
+	unix.Madvise(buffer, unix.MADV_DONTDUMP)
+
+	copy(buffer, data)
+	return buffer[:len(data)], nil
+}
+
+// release wipes and frees a buffer from lockedCopy
+func release(buffer []byte) {
+	buffer = buffer[:cap(buffer)]
+	clear(buffer)
+	unix.Munlock(buffer)
+	unix.Munmap(buffer)
+}
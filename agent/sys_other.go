@@ -0,0 +1,24 @@
+//go:build !linux
+
+package agent
+
+import (
+	"errors"
+	"net"
+)
+
+var errUnsupported = errors.New("the pass-env agent is only available on Linux")
+
+func supported() error {
+	return errUnsupported
+}
+
+func peerUID(conn net.Conn) (int, error) {
+	return -1, errUnsupported
+}
+
+func lockedCopy(data []byte) ([]byte, error) {
+	return nil, errUnsupported
+}
+
+func release(buffer []byte) {}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/otard95/pass-env/agent"
+	"github.com/otard95/pass-env/config"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flag_agentIdleTimeout time.Duration
+	flag_agentStop        bool
+)
+
+// agentCmd represents the agent command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Hold fetched secrets in memory for other pass-env runs",
+	Long: `Run an agent that holds cached secrets in memory, locked so it is never
+swapped to disk, and serves them to your own pass-env runs over a Unix socket
+in $XDG_RUNTIME_DIR, or at $PASS_ENV_AGENT_SOCK. Connections from other users
+are refused.
+
+While the agent is running, pass-env asks it before the on-disk cache, and
+hands it freshly fetched secrets instead of writing them to disk. Entries
+found on disk are handed to it as well. Nothing the agent holds outlives it.
+
+The agent runs in the foreground until it is interrupted, stopped with
+--stop, or nothing has asked it anything for the idle timeout. The timeout
+defaults to the 'agent-idle-timeout' config setting, or 1h.`,
+	Example: `  # Start the agent in the background, exiting after 15 idle minutes
+  pass-env agent --idle-timeout 15m &
+
+  # Forget everything and stop it
+  pass-env agent --stop`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if flag_agentStop {
+			err := agent.Stop()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		idleTimeout := config.Settings.Duration("agent-idle-timeout", time.Hour)
+		if cmd.Flags().Changed("idle-timeout") {
+			idleTimeout = flag_agentIdleTimeout
+		}
+
+		sock, err := agent.SocketPath()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		fmt.Fprintf(os.Stderr, "Starting pass-env agent on %s\n", sock)
+		err = agent.Serve(ctx, idleTimeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	agentCmd.Flags().DurationVar(&flag_agentIdleTimeout, "idle-timeout", 0, "Exit after this long without requests, 0 for never")
+	agentCmd.Flags().BoolVar(&flag_agentStop, "stop", false, "Stop the running agent")
+	rootCmd.AddCommand(agentCmd)
+}
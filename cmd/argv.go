@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/otard95/pass-env/config"
+	"github.com/otard95/pass-env/state"
+)
+
+// Matches '{{pass:PASS_NAME}}' placeholders in the command's arguments
+var argSecretPattern = regexp.MustCompile(`\{\{pass:([^{}\s]+)\}\}`)
+
+const argvWarning = `Warning: secrets substituted into command arguments are visible to other
+users on this system, e.g. through ps(1) or /proc/<pid>/cmdline. Prefer
+NAME=PASS_NAME pairs whenever the command can read the secret from its
+environment.`
+
+// findArgSecrets returns the placeholders in command mapped to their pass
+// names. Placeholders only name pass entries: the arguments may come from
+// anywhere, so a scheme in them, e.g. {{pass:cmd:...}}, is part of the pass
+// name rather than a way to run a command or read a file.
+func findArgSecrets(command []string) map[string]string {
+	placeholders := make(map[string]string)
+	for _, arg := range command {
+		for _, match := range argSecretPattern.FindAllStringSubmatch(arg, -1) {
+			passName := match[1]
+			if scheme, _ := state.SplitRef(passName); scheme != "pass" {
+				passName = "pass:" + passName
+			}
+			placeholders[match[0]] = passName
+		}
+	}
+	return placeholders
+}
+
+// checkArgSecrets refuses argument substitution in strict mode unless it was
+// explicitly allowed, and warns about the exposure otherwise
+func checkArgSecrets(parsed *ParsedArgs) error {
+	if len(parsed.ArgSecrets) == 0 {
+		return nil
+	}
+
+	if config.Settings.Bool("strict-argv-secrets") && !parsed.Opts.AllowArgvSecrets {
+		return fmt.Errorf(
+			"refusing to substitute secrets into command arguments, use --pe-allow-argv-secrets to allow it",
+		)
+	}
+
+	if !parsed.Opts.AllowArgvSecrets {
+		fmt.Fprintln(os.Stderr, argvWarning)
+	}
+
+	return nil
+}
+
+// substituteArgSecrets replaces every placeholder in command with its secret
+func substituteArgSecrets(command []string, secrets map[string]string) []string {
+	substituted := make([]string, len(command))
+	for i, arg := range command {
+		substituted[i] = argSecretPattern.ReplaceAllStringFunc(arg, func(placeholder string) string {
+			return secrets[placeholder]
+		})
+	}
+	return substituted
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/otard95/pass-env/state"
+)
+
+func TestArgSecretsOnlyNamePassEntries(t *testing.T) {
+	oldPath := state.Path
+	state.Path = t.TempDir()
+	t.Cleanup(func() { state.Path = oldPath })
+
+	marker := filepath.Join(t.TempDir(), "ran")
+	command := []string{"echo", "{{pass:cmd:touch$IFS" + marker + "}}", "{{pass:file:/etc/passwd}}", "{{pass:prod/db}}"}
+
+	placeholders := findArgSecrets(command)
+	for placeholder, ref := range placeholders {
+		if scheme, _ := state.SplitRef(ref); scheme != "pass" {
+			t.Errorf("Expected %s to name a pass entry, got %s", placeholder, ref)
+		}
+	}
+	if ref := placeholders["{{pass:prod/db}}"]; ref != "prod/db" {
+		t.Errorf("Expected {{pass:prod/db}} to name prod/db, got %s", ref)
+	}
+
+	for _, ref := range placeholders {
+		if secret, err := state.ResolveSecret(context.Background(), ref); err == nil {
+			t.Errorf("Expected %s not to resolve, got %q", ref, secret.Value)
+		}
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("Expected the command in the placeholder not to be run")
+	}
+}
@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/otard95/pass-env/config"
+	"github.com/otard95/pass-env/state"
+	"github.com/spf13/cobra"
+)
+
+var flag_json, flag_reveal bool
+
+const maskedValue = "********"
+
+// cacheCmd represents the cache command
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect pass-env's cache",
+	Long: `Inspect the entries in pass-env's internal store, which caches the secrets
+fetched for each set of NAME=PASS_NAME pairs.`,
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the cached entries",
+	Long: `List every cached entry with its variable names, the pass names it was
+fetched from, its age, TTL and when it was last used.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		requireInitialized()
+		configureCache()
+
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		hashes, err := state.ListCache()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		infos := make([]cacheInfo, 0, len(hashes))
+		for _, hash := range hashes {
+			info, err := readCacheInfo(ctx, hash)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+				continue
+			}
+			info.Values = nil
+			infos = append(infos, *info)
+		}
+
+		if flag_json {
+			printJSON(infos)
+			return
+		}
+
+		if len(infos) == 0 {
+			fmt.Println("The cache is empty.")
+			return
+		}
+
+		for i, info := range infos {
+			if i > 0 {
+				fmt.Println()
+			}
+			printCacheInfo(&info)
+		}
+	},
+}
+
+var cacheShowCmd = &cobra.Command{
+	Use:   "show HASH|ALIAS",
+	Short: "Show a cached entry",
+	Long: `Show a cached entry, given its hash or an alias whose pairs it was cached
+for. Values are masked unless --reveal is given.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		requireInitialized()
+		configureCache()
+
+		hash := args[0]
+		if _, isAlias := config.Alieses[hash]; isAlias {
+			parsed, err := parseArgs(args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			hash = cacheKeyOf(parsed)
+		}
+
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		info, err := readCacheInfo(ctx, hash)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if !flag_reveal {
+			for key := range info.Values {
+				info.Values[key] = maskedValue
+			}
+		}
+
+		if flag_json {
+			printJSON(info)
+			return
+		}
+
+		printCacheInfo(info)
+		fmt.Println("  Values:")
+		for _, key := range info.Variables {
+			fmt.Printf("    %s=%s\n", key, info.Values[key])
+		}
+	},
+}
+
+// cacheInfo is what the cache commands show about an entry
+type cacheInfo struct {
+	Hash      string            `json:"hash"`
+	Variables []string          `json:"variables"`
+	PassNames []string          `json:"pass_names"`
+	Created   *time.Time        `json:"created,omitempty"`
+	TTL       string            `json:"ttl"`
+	Expired   bool              `json:"expired"`
+	Scope     string            `json:"scope"`
+	InScope   bool              `json:"in_scope"`
+	LastUsed  *time.Time        `json:"last_used,omitempty"`
+	WrittenBy string            `json:"written_by,omitempty"`
+	Legacy    bool              `json:"legacy"`
+	Values    map[string]string `json:"values,omitempty"`
+}
+
+func readCacheInfo(ctx context.Context, hash string) (*cacheInfo, error) {
+	entry, err := state.ReadCacheEntry(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &cacheInfo{
+		Hash:      hash,
+		PassNames: entry.PassNames,
+		TTL:       "never",
+		Expired:   entry.Expired(time.Now()),
+		Scope:     string(entry.Scope()),
+		InScope:   entry.InScope(),
+		WrittenBy: entry.WrittenBy,
+		Legacy:    entry.IsLegacy(),
+		Values:    entry.Values,
+	}
+	for key := range entry.Values {
+		info.Variables = append(info.Variables, key)
+	}
+	slices.Sort(info.Variables)
+
+	if !entry.Created.IsZero() {
+		info.Created = &entry.Created
+	}
+	if entry.TTL > 0 {
+		info.TTL = entry.TTL.String()
+	}
+	if lastUsed, found := state.LastUsed(hash); found {
+		info.LastUsed = &lastUsed
+	}
+
+	return info, nil
+}
+
+func printCacheInfo(info *cacheInfo) {
+	fmt.Println(info.Hash)
+	fmt.Printf("  Variables:  %s\n", strings.Join(info.Variables, " "))
+	if info.Legacy {
+		fmt.Println("  Legacy entry, written by an earlier pass-env without metadata")
+		return
+	}
+
+	fmt.Printf("  Pass names: %s\n", strings.Join(info.PassNames, " "))
+	fmt.Printf("  Age:        %s\n", formatSince(info.Created))
+	ttl := info.TTL
+	if info.Expired {
+		ttl += " (expired)"
+	}
+	fmt.Printf("  TTL:        %s\n", ttl)
+	scope := info.Scope
+	if !info.InScope {
+		scope += " (from another " + scope + ")"
+	}
+	fmt.Printf("  Scope:      %s\n", scope)
+	fmt.Printf("  Last used:  %s\n", formatSince(info.LastUsed))
+}
+
+func formatSince(t *time.Time) string {
+	if t == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s ago", time.Since(*t).Round(time.Second))
+}
+
+func printJSON(v any) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func requireInitialized() {
+	if !state.IsInitialized() {
+		fmt.Println("pass-env is not initialized. Run 'pass-env init' first.")
+		os.Exit(1)
+	}
+}
+
+func init() {
+	cacheCmd.PersistentFlags().BoolVar(&flag_json, "json", false, "Print the output as JSON")
+	cacheShowCmd.Flags().BoolVar(&flag_reveal, "reveal", false, "Show the cached values instead of masking them")
+
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cacheShowCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
@@ -1,48 +1,160 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/otard95/pass-env/agent"
+	"github.com/otard95/pass-env/config"
 	"github.com/otard95/pass-env/state"
 	"github.com/spf13/cobra"
 )
 
+var (
+	flag_clearAliases   []string
+	flag_clearVars      []string
+	flag_clearOlderThan time.Duration
+	flag_clearAll       bool
+	flag_clearDryRun    bool
+)
+
 // clearCmd represents the clear command
 var clearCmd = &cobra.Command{
-	Use:   "clear PASS_NAME...",
+	Use:   "clear [PASS_NAME|GLOB|PREFIX/...]",
 	Short: "Clear cached entries for the specified pass names",
 	Long: `Remove cached entries from pass-env's internal store that are associated
-with the specified password names from the main password store.`,
-	Args: cobra.MinimumNArgs(1),
+with the specified password names from the main password store.
+
+Pass names may be globs like 'prod/*' or prefixes like 'prod/', both of which
+match everything under the directories they match. Entries can also be
+selected by alias, by the variables they set, or all at once. Entries
+matching any of these are cleared, --older-than narrows that down to entries
+older than the given duration, or selects by age alone.
+
+Entries held by a running agent are cleared the same way.`,
+	Example: `  # Clear everything cached from prod/
+  pass-env clear 'prod/*'
+
+  # Clear the entry for an alias and anything setting GITHUB_TOKEN
+  pass-env clear --alias deploy --var GITHUB_TOKEN
+
+  # Preview clearing entries older than a day
+  pass-env clear --older-than 24h --dry-run
+
+  # Clear everything, e.g. after rotating secrets
+  pass-env clear --all`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if !state.IsInitialized() {
 			fmt.Println("pass-env is not initialized. Run 'pass-env init' first.")
 			return
 		}
+		configureCache()
+
+		if len(args) == 0 && len(flag_clearAliases) == 0 && len(flag_clearVars) == 0 &&
+			flag_clearOlderThan == 0 && !flag_clearAll {
+			fmt.Fprintln(os.Stderr, "Error: nothing to clear, give a pass name or one of --alias, --var, --older-than or --all")
+			os.Exit(1)
+		}
+
+		selector := state.CacheSelector{
+			PassNames: args,
+			Vars:      flag_clearVars,
+			OlderThan: flag_clearOlderThan,
+			All:       flag_clearAll,
+		}
+		for _, alias := range flag_clearAliases {
+			if _, exists := config.Alieses[alias]; !exists {
+				fmt.Fprintf(os.Stderr, "Error: unknown alias '%s'\n", alias)
+				os.Exit(1)
+			}
+			parsed, err := parseArgs([]string{alias})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			selector.Hashes = append(selector.Hashes, cacheKeyOf(parsed))
+		}
+
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		selected, err := state.SelectCache(ctx, selector)
+		if err != nil {
+			fmt.Printf("Error selecting cache entries: %s\n", err)
+			return
+		}
 
-		cacheEntries := state.GetDependents(args...)
+		held, err := agent.Clear(selector, flag_clearDryRun)
+		if err != nil && !errors.Is(err, agent.ErrNotRunning) {
+			fmt.Printf("Error clearing entries held by the agent: %s\n", err)
+		}
+		printSelections("entries held by the agent", held)
+
+		if len(selected) == 0 {
+			if len(held) == 0 {
+				fmt.Println("No cache entries found for the specified selection.")
+			}
+			return
+		}
 
-		if len(cacheEntries) == 0 {
-			fmt.Println("No cache entries found for the specified pass names.")
+		if flag_clearDryRun {
+			printSelections("cache entries", selected)
 			return
 		}
 
-		err := state.Clear(cacheEntries...)
+		hashes := make([]string, 0, len(selected))
+		for _, entry := range selected {
+			hashes = append(hashes, entry.Hash)
+		}
+
+		err = state.Clear(ctx, hashes...)
 		if err != nil {
 			fmt.Printf("Error clearing cache entries: %s\n", err)
 			return
 		}
 
-		err = state.RemoveFromIndex(args...)
+		err = state.RemoveHashesFromIndex(ctx, hashes...)
 		if err != nil {
 			fmt.Printf("Error updating index: %s\n", err)
 			return
 		}
 
-		fmt.Printf("Cleared %d cache entries for: %v\n", len(cacheEntries), args)
+		printSelections("cache entries", selected)
 	},
 }
 
+// printSelections reports what was, or with --dry-run would be, cleared
+func printSelections(what string, selected []state.CacheSelection) {
+	if len(selected) == 0 {
+		return
+	}
+
+	verb := "Cleared"
+	if flag_clearDryRun {
+		verb = "Would clear"
+	}
+	fmt.Printf("%s %d %s:\n", verb, len(selected), what)
+	for _, entry := range selected {
+		printSelection(entry)
+	}
+}
+
+func printSelection(entry state.CacheSelection) {
+	if len(entry.PassNames) == 0 {
+		fmt.Printf("  %s\n", entry.Hash)
+		return
+	}
+	fmt.Printf("  %s (%s)\n", entry.Hash, strings.Join(entry.PassNames, " "))
+}
+
 func init() {
+	clearCmd.Flags().StringSliceVar(&flag_clearAliases, "alias", nil, "Clear the entry cached for this alias")
+	clearCmd.Flags().StringSliceVar(&flag_clearVars, "var", nil, "Clear entries setting this variable")
+	clearCmd.Flags().DurationVar(&flag_clearOlderThan, "older-than", 0, "Only clear entries older than this, e.g. 24h")
+	clearCmd.Flags().BoolVar(&flag_clearAll, "all", false, "Clear every cached entry")
+	clearCmd.Flags().BoolVarP(&flag_clearDryRun, "dry-run", "n", false, "Only show what would be cleared")
 	rootCmd.AddCommand(clearCmd)
 }
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/otard95/pass-env/state"
+)
+
+// DirOpts controls how the entries of --pe-from-dir directories are turned
+// into environment variables
+type DirOpts struct {
+	Dirs    []string
+	Upper   bool
+	Prefix  string
+	Filters []string
+}
+
+// addDirPairs adds a NAME=PASS_NAME pair for every entry under the
+// --pe-from-dir directories, named after the entry's base name. Directories
+// may have a scheme prefix, e.g. file:/run/secrets. Pairs given
+// explicitly take precedence over the ones found in a directory.
+func addDirPairs(parsed *ParsedArgs) error {
+	opts := parsed.Opts.Dir
+	found := make(map[string]string)
+
+	for _, dir := range opts.Dirs {
+		passNames, err := state.ListSecrets(strings.Trim(dir, "/"))
+		if err != nil {
+			return err
+		}
+
+		for _, passName := range passNames {
+			base := path.Base(passName)
+			if !matchesAny(opts.Filters, base) {
+				continue
+			}
+
+			name := base
+			if opts.Upper {
+				name = strings.ToUpper(name)
+			}
+			name = opts.Prefix + name
+
+			if strings.Contains(name, "=") {
+				return fmt.Errorf("'%s' can't be used as a variable name", name)
+			}
+			if other, exists := found[name]; exists && other != passName {
+				return fmt.Errorf("both '%s' and '%s' would be set as %s", other, passName, name)
+			}
+			found[name] = passName
+		}
+	}
+
+	for name, passName := range found {
+		if _, exists := parsed.EnvPairs[name]; exists {
+			continue
+		}
+		if _, exists := parsed.FdPairs[name]; exists {
+			continue
+		}
+		parsed.EnvPairs[name] = passName
+	}
+
+	return nil
+}
+
+func matchesAny(globs []string, name string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(globs, func(glob string) bool {
+		matched, _ := path.Match(glob, name)
+		return matched
+	})
+}
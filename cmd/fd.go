@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The prefix of a pass name that is delivered over a file descriptor
+const fdPrefix = "fd:"
+
+// The first file descriptor available to the command after stdin, stdout
+// and stderr
+const firstExtraFd = 3
+
+func fdKey(name string) string {
+	return fdPrefix + name
+}
+
+// openSecretFds creates one pipe per fd pair, holding only its secret, and
+// returns the read ends to hand to the command along with the NAME_FD=N
+// variables that tell the command where to find them
+func openSecretFds(fdPairs map[string]string, secrets map[string]string) ([]*os.File, []string, error) {
+	names := make([]string, 0, len(fdPairs))
+	for name := range fdPairs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]*os.File, 0, len(names))
+	envs := make([]string, 0, len(names))
+	for i, name := range names {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("failed to create pipe for %s: %s", name, err)
+		}
+
+		// Written in the background so large secrets can't fill the pipe
+		// buffer before the command starts reading
+		go func(w *os.File, secret string) {
+			defer w.Close()
+			w.WriteString(secret)
+		}(w, secrets[fdKey(name)])
+
+		files = append(files, r)
+		envs = append(envs, fmt.Sprintf("%s_FD=%d", name, firstExtraFd+i))
+	}
+
+	return files, envs, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func isFdPassName(passName string) bool {
+	return strings.HasPrefix(passName, fdPrefix)
+}
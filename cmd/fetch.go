@@ -0,0 +1,389 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/otard95/pass-env/agent"
+	"github.com/otard95/pass-env/config"
+	"github.com/otard95/pass-env/state"
+)
+
+// argsError is a problem with what was asked for, rather than with fetching it
+type argsError struct {
+	error
+}
+
+func isArgsError(err error) bool {
+	var target argsError
+	return errors.As(err, &target)
+}
+
+// The exit status for each kind of fetch failure, see EXIT STATUS in the
+// root command's help
+var fetchExitCodes = map[state.ErrorKind]int{
+	state.ErrNotFound:       129,
+	state.ErrCancelled:      130,
+	state.ErrDecryptFailed:  131,
+	state.ErrUnavailable:    132,
+	state.ErrTimeout:        133,
+	state.ErrUnlockRequired: 134,
+}
+
+// notCachedError is a secret --pe-cache-only can't take from the cache
+type notCachedError struct {
+	error
+}
+
+// neverCachedError is the notCachedError for requests that are never cached
+func neverCachedError(requests map[string]string) error {
+	passNames := slices.Compact(slices.Sorted(maps.Values(requests)))
+	return notCachedError{fmt.Errorf("--pe-cache-only can't use secrets that are never cached: %s", strings.Join(passNames, ", "))}
+}
+
+// loadExitCode returns the exit status for an error from loadSecrets
+func loadExitCode(err error) int {
+	if isArgsError(err) {
+		return 128
+	}
+	if errors.As(err, new(notCachedError)) {
+		return 135
+	}
+
+	var fetchErr *state.FetchError
+	if errors.As(err, &fetchErr) {
+		if code, ok := fetchExitCodes[fetchErr.Kind()]; ok {
+			return code
+		}
+	}
+	return 1
+}
+
+// configureAgeIdentity applies the 'age-identity' config setting, used by the
+// age backend and to encrypt the index of a passage store
+func configureAgeIdentity() {
+	state.AgeIdentity = config.Settings.String("age-identity", state.DefaultAgeIdentity())
+}
+
+// configureCache selects the cache backend named by the 'cache-backend'
+// config setting. Only commands that read or write the cache call it, so a
+// bad setting doesn't break the others.
+func configureCache() {
+	backend, err := cacheBackendFromConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid config: %v\n", err)
+		os.Exit(128)
+	}
+	state.SetCacheBackend(backend)
+}
+
+func cacheBackendName() string {
+	return config.Settings.String("cache-backend", "pass")
+}
+
+func cacheBackendFromConfig() (state.CacheBackend, error) {
+	switch name := cacheBackendName(); name {
+	case "pass":
+		return state.NewPassBackend(), nil
+	case "keyring":
+		return state.NewKeyringBackend(config.Settings.String("keyring", state.KeyringUser))
+	case "age":
+		return state.NewAgeBackend(state.AgeIdentity)
+	case "memory":
+		return state.NewMemoryBackend(), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend '%s', expected pass, keyring, age or memory", name)
+	}
+}
+
+// configureFetch applies the 'fetch-concurrency' and 'non-interactive' config
+// settings, and lets 'direct-gpg: false' send every decryption through
+// pass(1)
+func configureFetch() {
+	state.FetchConcurrency = config.Settings.Int("fetch-concurrency", state.FetchConcurrency)
+	state.Interactive = canPrompt()
+	if _, set := config.Settings["non-interactive"]; set {
+		state.Interactive = !config.Settings.Bool("non-interactive")
+	}
+	if _, set := config.Settings["direct-gpg"]; set {
+		state.DirectGPG = config.Settings.Bool("direct-gpg")
+	}
+}
+
+// canPrompt reports whether there is a terminal or a display for pinentry and
+// passphrase prompts to use
+func canPrompt() bool {
+	if os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != "" {
+		return true
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	tty.Close()
+	return true
+}
+
+// interruptContext returns a context cancelled by Ctrl-C or SIGTERM, which
+// stops the gpg and pass(1) runs started under it
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// fetchContext returns the context secrets are fetched under, cancelled by
+// Ctrl-C or SIGTERM and once the fetch timeout of opts has passed
+func fetchContext(opts PassEnvOpts) (context.Context, context.CancelFunc) {
+	ctx, stop := interruptContext()
+
+	timeout := opts.fetchTimeout()
+	if timeout <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// splitCacheable separates the requests for pass names the 'never-cache'
+// config setting matches from the rest
+func splitCacheable(requests map[string]string) (cacheable, fresh map[string]string) {
+	patterns := config.Settings.List("never-cache")
+	cacheable = make(map[string]string, len(requests))
+	fresh = make(map[string]string)
+
+	for key, passName := range requests {
+		neverCache := slices.ContainsFunc(patterns, func(pattern string) bool {
+			return state.MatchPassName(pattern, passName)
+		})
+		if neverCache {
+			fresh[key] = passName
+		} else {
+			cacheable[key] = passName
+		}
+	}
+
+	return cacheable, fresh
+}
+
+// cacheKeyOf returns the key of the cache entry holding the cacheable secrets
+// parsed asks for
+func cacheKeyOf(parsed *ParsedArgs) string {
+	cacheable, _ := splitCacheable(parsed.SecretRequests())
+	return generateCacheKey(cacheable)
+}
+
+// loadSecrets returns the resolved secrets parsed asks for, and whether they
+// came from the cache. Secrets that must never be cached, by config or by a
+// 'cache: never' line in their entry, are fetched on every call.
+func loadSecrets(ctx context.Context, parsed *ParsedArgs) (map[string]string, bool, error) {
+	requests := parsed.SecretRequests()
+	cacheable, fresh := splitCacheable(requests)
+	cacheKey := generateCacheKey(cacheable)
+
+	useCache := !parsed.Opts.NoCache && len(cacheable) > 0
+	useAgent := useCache && agent.Running()
+
+	if useCache && !parsed.Opts.Refresh {
+		if entry, hit := cachedEntry(ctx, cacheKey, useAgent); hit {
+			maps.Copy(fresh, entry.Uncached)
+			if parsed.Opts.CacheOnly && len(fresh) > 0 {
+				return nil, false, neverCachedError(fresh)
+			}
+			fetched, err := fetchRequests(ctx, fresh)
+			if err != nil {
+				return nil, false, err
+			}
+			maps.Copy(fetched, cachedSecrets(entry))
+			secrets, _, err := resolveSecrets(parsed, fetched)
+			if err != nil {
+				return nil, false, err
+			}
+			return secrets, true, nil
+		}
+	}
+
+	if parsed.Opts.CacheOnly && len(cacheable) == 0 {
+		return nil, false, neverCachedError(fresh)
+	}
+	if parsed.Opts.CacheOnly {
+		return nil, false, notCachedError{errors.New("the secrets aren't cached, and --pe-cache-only doesn't fetch them")}
+	}
+
+	fetched, err := state.FetchSecrets(ctx, requests)
+	if err != nil {
+		return nil, false, err
+	}
+
+	storableSelectors := make(map[string]string)
+	uncached := make(map[string]string)
+	for key, secret := range fetched {
+		if _, isCacheable := cacheable[key]; !isCacheable {
+			continue
+		}
+		if secret.NeverCache() {
+			uncached[key] = requests[key]
+			continue
+		}
+		storableSelectors[key] = requests[key]
+	}
+
+	secrets, named, err := resolveSecrets(parsed, fetched)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if useCache && !parsed.Opts.NoStore && len(storableSelectors) > 0 {
+		values, storedNames := storableValues(secrets, named, storableSelectors)
+		entry := state.NewCacheEntry(values, storableSelectors)
+		entry.Named = storedNames
+		entry.Uncached = uncached
+		entry.TTL = parsed.Opts.cacheTTL()
+		err = bindCacheEntry(entry)
+		if err == nil {
+			err = storeEntry(ctx, cacheKey, entry, useAgent)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+
+	return secrets, false, nil
+}
+
+// storableValues picks the resolved secrets whose requests are among
+// selectors, along with the variables of them that @PASS_NAME requests set
+func storableValues(secrets, named, selectors map[string]string) (map[string]string, map[string]string) {
+	values := make(map[string]string)
+	storedNames := make(map[string]string)
+	for key, value := range secrets {
+		requestKey := key
+		passName, isNamed := named[key]
+		if isNamed {
+			requestKey = namedKey(passName)
+		}
+		if _, isStorable := selectors[requestKey]; !isStorable {
+			continue
+		}
+
+		values[key] = value
+		if isNamed {
+			storedNames[key] = passName
+		}
+	}
+	return values, storedNames
+}
+
+// isCached reports whether the secrets parsed asks for have a cache entry
+func isCached(ctx context.Context, parsed *ParsedArgs) bool {
+	cacheable, _ := splitCacheable(parsed.SecretRequests())
+	if parsed.Opts.NoCache || len(cacheable) == 0 {
+		return false
+	}
+
+	_, hit := cachedEntry(ctx, generateCacheKey(cacheable), agent.Running())
+	return hit
+}
+
+// cachedEntry returns the entry cached under cacheKey, asking the agent before
+// the on-disk cache. Entries found on disk are handed to the agent, if it is
+// used.
+func cachedEntry(ctx context.Context, cacheKey string, useAgent bool) (*state.CacheEntry, bool) {
+	if useAgent {
+		entry, hit, err := agent.Get(cacheKey)
+		if err == nil && hit && entry.InScope() {
+			return entry, true
+		}
+	}
+
+	entry, hit := state.GetCacheEntry(ctx, cacheKey)
+	if !hit {
+		return nil, false
+	}
+	touchCache(cacheKey)
+
+	if useAgent && !entry.IsLegacy() {
+		err := agent.Set(cacheKey, entry)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to hand cached secrets to the agent: %v\n", err)
+		}
+	}
+
+	return entry, true
+}
+
+func fetchRequests(ctx context.Context, requests map[string]string) (map[string]state.Secret, error) {
+	if len(requests) == 0 {
+		return make(map[string]state.Secret), nil
+	}
+
+	return state.FetchSecrets(ctx, requests)
+}
+
+// bindCacheEntry ties entry to the boot or login session, as the
+// 'cache-scope' config setting asks
+func bindCacheEntry(entry *state.CacheEntry) error {
+	scope, err := state.ParseCacheScope(config.Settings.String("cache-scope", ""))
+	if err != nil {
+		return fmt.Errorf("not caching secrets: %v", err)
+	}
+
+	err = entry.BindTo(scope)
+	if err != nil {
+		return fmt.Errorf("not caching secrets: %v", err)
+	}
+
+	return nil
+}
+
+// storeEntry hands entry to the agent if it is used, and caches it on disk
+// otherwise, or if the agent won't take it
+func storeEntry(ctx context.Context, cacheKey string, entry *state.CacheEntry, useAgent bool) error {
+	if useAgent {
+		err := agent.Set(cacheKey, entry)
+		if err == nil {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "Warning: the agent did not take the secrets, caching them on disk: %v\n", err)
+	}
+
+	err := cacheSecrets(ctx, cacheKey, entry)
+	if err != nil {
+		return err
+	}
+	touchCache(cacheKey)
+	return nil
+}
+
+// cacheSecrets stores entry under cacheKey, and links it to its pass names in
+// the index
+func cacheSecrets(ctx context.Context, cacheKey string, entry *state.CacheEntry) error {
+	err := state.SetCacheEntry(ctx, cacheKey, entry)
+	if err != nil {
+		return fmt.Errorf("failed to cache secrets: %v", err)
+	}
+
+	err = state.UpdateIndex(ctx, cacheKey, entry.PassNames)
+	if err != nil {
+		return fmt.Errorf("failed to update index: %v", err)
+	}
+
+	return nil
+}
+
+func touchCache(cacheKey string) {
+	err := state.TouchCache(cacheKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record cache use: %v\n", err)
+	}
+}
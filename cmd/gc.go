@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/otard95/pass-env/state"
+	"github.com/spf13/cobra"
+)
+
+var flag_dryRun, flag_rebuildIndex bool
+
+// gcCmd represents the gc command
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Reconcile the cache with its index",
+	Long: `Remove cache entries that no pass name in the index refers to, and index
+links to cache entries that no longer exist.
+
+With --rebuild-index, every cache entry is decrypted and the index links are
+made to match the pass names recorded in its metadata. This restores links
+lost to e.g. a failed index update.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		requireInitialized()
+		configureCache()
+
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		report, err := state.GC(ctx, flag_rebuildIndex, flag_dryRun)
+		if report != nil {
+			printGCReport(report)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func printGCReport(report *state.GCReport) {
+	verb := "Removed"
+	if flag_dryRun {
+		verb = "Would remove"
+	}
+
+	for _, hash := range report.Unreadable {
+		fmt.Printf("Could not read cache entry %s\n", hash)
+	}
+
+	if report.Empty() {
+		fmt.Println("The cache and index are consistent, nothing to do.")
+		return
+	}
+
+	printLinks := func(heading string, links []state.IndexLink) {
+		if len(links) == 0 {
+			return
+		}
+		fmt.Println(heading)
+		for _, link := range links {
+			fmt.Printf("  %s -> %s\n", link.PassName, link.Hash)
+		}
+	}
+
+	if flag_dryRun {
+		printLinks("Would restore index links:", report.RestoredLinks)
+	} else {
+		printLinks("Restored index links:", report.RestoredLinks)
+	}
+	printLinks(verb+" index links to missing cache entries:", report.DanglingLinks)
+	printLinks(verb+" index links not matching the entry's metadata:", report.StaleLinks)
+
+	if len(report.OrphanedEntries) > 0 {
+		fmt.Println(verb + " cache entries not in the index:")
+		for _, hash := range report.OrphanedEntries {
+			fmt.Printf("  %s\n", hash)
+		}
+	}
+}
+
+func init() {
+	gcCmd.Flags().BoolVarP(&flag_dryRun, "dry-run", "n", false, "Only report what would be changed")
+	gcCmd.Flags().BoolVar(
+		&flag_rebuildIndex, "rebuild-index", false,
+		"Make the index match the metadata of every cache entry",
+	)
+	rootCmd.AddCommand(gcCmd)
+}
@@ -22,7 +22,14 @@ var initCmd = &cobra.Command{
 
 	This command will try and find your existing pass-store and its gpg key, if
 	fails to do so or you wan't to use a different one, you can use the
-	--pass-store and --gpg flags to specify these.`,
+	--pass-store and --gpg flags to specify these.
+
+	Without a pass-store, a passage store in $PASSAGE_DIR or ~/.passage/store
+	is used instead. Its entries are decrypted with the age identities in
+	$PASSAGE_IDENTITIES_FILE or ~/.passage/identities. pass-env's own store
+	needs a gpg key from --gpg, unless the cache-backend is age or keyring.
+	Then no gpg is needed at all, and the index is encrypted with the
+	age-identity.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if state.IsInitialized() {
 			log.Fatalln("pass-env is already initialized")
@@ -33,16 +40,40 @@ var initCmd = &cobra.Command{
 			os.Getenv("PASSWORD_STORE_DIR"),
 			os.Getenv("HOME")+"/.password-store",
 		)
+		if err != nil && flag_passStore == "" && state.IsPassageStore(state.PassageStore()) {
+			passStore, err = state.PassageStore(), nil
+		}
 		if err != nil {
 			log.Fatalf("Could not find pass store: %s", err)
 		}
 
-		gpgKey, err := findGPGKeyInPath(passStore)
-		if err != nil {
-			log.Fatalf("Could not automatically find gpg key: %s", err)
+		gpgKey := flag_gpg
+		passage := state.IsPassageStore(passStore)
+		if gpgKey == "" && passage && !slices.Contains([]string{"age", "keyring"}, cacheBackendName()) {
+			log.Fatalf(
+				"'%s' is a passage store, which has no gpg key to encrypt pass-env's own store with. "+
+					"Give one with --gpg, or use 'cache-backend: age' or 'keyring', which don't need gpg.",
+				passStore,
+			)
 		}
+		if gpgKey == "" && !passage {
+			gpgKey, err = findGPGKeyInPath(passStore)
+			if err != nil {
+				log.Fatalf("Could not automatically find gpg key: %s", err)
+			}
+		}
+
+		if passage {
+			fmt.Printf("Using passage store '%s', decrypted with the identities in '%s'\n", passStore, state.PassageIdentities())
+		}
+		if gpgKey == "" {
+			fmt.Printf("Encrypting pass-env's index with the age identity in '%s'\n", state.AgeIdentity)
+		}
+
+		ctx, cancel := interruptContext()
+		defer cancel()
 
-		err = state.Init(passStore, gpgKey)
+		err = state.Init(ctx, passStore, gpgKey)
 		if err != nil {
 			log.Fatalf("Failed to initialize: %s", err)
 		}
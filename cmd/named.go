@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/otard95/pass-env/state"
+)
+
+// The prefix of a pass name whose entry declares its own variable name
+const namedPrefix = "@"
+
+// The metadata line of a pass entry that declares its variable name
+const namedMetaKey = "env"
+
+func isNamedSecret(s string) bool {
+	return strings.HasPrefix(s, namedPrefix)
+}
+
+func namedKey(passName string) string {
+	return namedPrefix + passName
+}
+
+// resolveSecrets turns fetched secrets into the values to deliver. Secrets
+// requested as @PASS_NAME are keyed by the variable name from the entry's
+// 'env:' line, or by one derived from the pass name if there is none. The
+// variables they set are returned as well, NAME -> PASS_NAME.
+func resolveSecrets(parsed *ParsedArgs, fetched map[string]state.Secret) (map[string]string, map[string]string, error) {
+	secrets := make(map[string]string, len(fetched))
+	named := make(map[string]string)
+
+	for key, secret := range fetched {
+		if !isNamedSecret(key) {
+			secrets[key] = secret.Value
+			continue
+		}
+
+		passName := strings.TrimPrefix(key, namedPrefix)
+		name := secret.Meta[namedMetaKey]
+		if name == "" {
+			name = deriveVarName(passName)
+		}
+		if strings.Contains(name, "=") {
+			return nil, nil, argsError{fmt.Errorf("'%s' declares an invalid variable name: %s", passName, name)}
+		}
+		if other, exists := named[name]; exists {
+			return nil, nil, argsError{fmt.Errorf("both '%s' and '%s' would be set as %s", other, passName, name)}
+		}
+		named[name] = passName
+	}
+
+	for name, passName := range named {
+		if _, exists := parsed.EnvPairs[name]; exists {
+			delete(named, name)
+			continue
+		}
+		if _, exists := parsed.FdPairs[name]; exists {
+			delete(named, name)
+			continue
+		}
+		secrets[name] = fetched[namedKey(passName)].Value
+	}
+
+	return secrets, named, nil
+}
+
+// cachedSecrets turns the values of a cache entry back into the secrets they
+// were resolved from, so they are resolved again along with those fetched on
+// a hit
+func cachedSecrets(entry *state.CacheEntry) map[string]state.Secret {
+	fetched := make(map[string]state.Secret, len(entry.Values))
+	for key, value := range entry.Values {
+		if passName, isNamed := entry.Named[key]; isNamed {
+			fetched[namedKey(passName)] = state.Secret{Value: value, Meta: map[string]string{namedMetaKey: key}}
+			continue
+		}
+		fetched[key] = state.Secret{Value: value}
+	}
+	return fetched
+}
+
+// deriveVarName turns a pass name like 'github/token' into GITHUB_TOKEN. The
+// scheme of other sources is left out, file:/run/secrets/db becomes
+// RUN_SECRETS_DB.
+func deriveVarName(passName string) string {
+	_, ref := state.SplitRef(passName)
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, strings.Trim(ref, "/"))
+
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/otard95/pass-env/state"
+)
+
+func TestResolveCachedSecrets(t *testing.T) {
+	parsed := &ParsedArgs{EnvPairs: map[string]string{"A": "prod/a"}}
+	entry := &state.CacheEntry{
+		Values: map[string]string{"A": "a", "DB": "db"},
+		Named:  map[string]string{"DB": "prod/db"},
+	}
+
+	secrets, named, err := resolveSecrets(parsed, cachedSecrets(entry))
+	if err != nil {
+		t.Fatalf("resolveSecrets failed: %v", err)
+	}
+	if !maps.Equal(secrets, entry.Values) || !maps.Equal(named, entry.Named) {
+		t.Errorf("Expected %v %v, got %v %v", entry.Values, entry.Named, secrets, named)
+	}
+
+	fetched := cachedSecrets(entry)
+	fetched[namedKey("prod/other")] = state.Secret{Value: "other", Meta: map[string]string{namedMetaKey: "DB"}}
+	if _, _, err := resolveSecrets(parsed, fetched); err == nil {
+		t.Error("Expected a fetched secret named like a cached one to fail")
+	}
+}
+
+func TestStorableValues(t *testing.T) {
+	secrets := map[string]string{"A": "a", "DB": "db", "TOKEN": "token"}
+	named := map[string]string{"DB": "prod/db", "TOKEN": "prod/token"}
+	selectors := map[string]string{"A": "prod/a", namedKey("prod/db"): "prod/db"}
+
+	values, storedNames := storableValues(secrets, named, selectors)
+	if !maps.Equal(values, map[string]string{"A": "a", "DB": "db"}) {
+		t.Errorf("Expected A and DB to be stored, got %v", values)
+	}
+	if !maps.Equal(storedNames, map[string]string{"DB": "prod/db"}) {
+		t.Errorf("Expected DB to be stored as named, got %v", storedNames)
+	}
+}
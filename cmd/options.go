@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/otard95/pass-env/config"
+)
+
+// PassEnvOpts are the options that belong to pass-env itself
+type PassEnvOpts struct {
+	AllowArgvSecrets bool
+	Dir              DirOpts
+	// Neither read nor write the cache
+	NoCache bool
+	// Read the cache, but don't write fetched secrets to it
+	NoStore bool
+	// Ignore any cached entry, and overwrite it with freshly fetched secrets
+	Refresh bool
+	// How long the cache entry written by this run stays valid
+	TTL time.Duration
+	// How long fetching the secrets may take
+	Timeout time.Duration
+	// Fail instead of asking for a passphrase
+	NonInteractive bool
+	// Only use the cache, never fetch secrets from their sources
+	CacheOnly bool
+}
+
+// cacheTTL is how long the cache entry written with these options stays
+// valid, zero meaning forever
+func (o PassEnvOpts) cacheTTL() time.Duration {
+	if o.TTL > 0 {
+		return o.TTL
+	}
+	return config.Settings.Duration("cache-ttl", 0)
+}
+
+// The deadline for fetching secrets when neither --pe-timeout nor the config
+// sets one
+const defaultFetchTimeout = 5 * time.Minute
+
+// fetchTimeout is how long fetching secrets with these options may take, zero
+// meaning no limit
+func (o PassEnvOpts) fetchTimeout() time.Duration {
+	if o.Timeout > 0 {
+		return o.Timeout
+	}
+	return config.Settings.Duration("fetch-timeout", defaultFetchTimeout)
+}
+
+// The prefix of pass-env's own options. No env(1) option, or abbreviation of
+// one, starts with it.
+const passEnvOptPrefix = "--pe-"
+
+// Options before this separator all belong to pass-env, with or without the
+// --pe- prefix
+const passEnvSeparator = "--pass-env--"
+
+// env(1) options that take their value as the next argument
+var envOptsWithValue = []string{"-u", "--unset", "-C", "--chdir", "-S", "--split-string"}
+
+func isCliFlag(s string) bool {
+	return strings.HasPrefix(s, "-")
+}
+
+func isPassEnvOpt(s string) bool {
+	return strings.HasPrefix(s, passEnvOptPrefix)
+}
+
+// parseOptions splits the leading options in args into pass-env's own options
+// and env(1) options, and returns the index of the first argument after them
+func parseOptions(args []string, parsed *ParsedArgs) (int, error) {
+	i := 0
+
+	if separator := slices.Index(args, passEnvSeparator); separator != -1 &&
+		!slices.ContainsFunc(args[:separator], func(arg string) bool { return !isCliFlag(arg) }) {
+		for ; i < separator; i++ {
+			opt := args[i]
+			if !isPassEnvOpt(opt) {
+				opt = passEnvOptPrefix + strings.TrimLeft(opt, "-")
+			}
+			err := parsePassEnvOpt(opt, parsed)
+			if err != nil {
+				return 0, err
+			}
+		}
+		i++
+	}
+
+	for ; i < len(args) && isCliFlag(args[i]); i++ {
+		if isPassEnvOpt(args[i]) {
+			err := parsePassEnvOpt(args[i], parsed)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		parsed.EnvOpts = append(parsed.EnvOpts, args[i])
+		if args[i] == "--" {
+			return i + 1, nil
+		}
+		if slices.Contains(envOptsWithValue, args[i]) {
+			if i+1 >= len(args) {
+				return 0, fmt.Errorf("env option %s requires an argument", args[i])
+			}
+			i++
+			parsed.EnvOpts = append(parsed.EnvOpts, args[i])
+		}
+	}
+
+	return i, nil
+}
+
+// checkOptions rejects combinations of pass-env's options that contradict
+// each other
+func checkOptions(opts PassEnvOpts) error {
+	if !opts.CacheOnly {
+		return nil
+	}
+	switch {
+	case opts.NoCache:
+		return fmt.Errorf("--pe-cache-only and --pe-no-cache contradict each other")
+	case opts.Refresh:
+		return fmt.Errorf("--pe-cache-only and --pe-refresh contradict each other")
+	case len(opts.Dir.Dirs) > 0:
+		return fmt.Errorf("--pe-from-dir lists the password store, which --pe-cache-only never touches")
+	}
+	return nil
+}
+
+func parsePassEnvOpt(s string, parsed *ParsedArgs) error {
+	opt, value, _ := strings.Cut(s, "=")
+	switch opt {
+	case "--pe-allow-argv-secrets":
+		parsed.Opts.AllowArgvSecrets = true
+	case "--pe-stdin":
+		return setStdinSecret(parsed, value)
+	case "--pe-from-dir":
+		if value == "" {
+			return fmt.Errorf("empty directory in %s", s)
+		}
+		parsed.Opts.Dir.Dirs = append(parsed.Opts.Dir.Dirs, value)
+	case "--pe-dir-upper":
+		parsed.Opts.Dir.Upper = true
+	case "--pe-dir-prefix":
+		parsed.Opts.Dir.Prefix = value
+	case "--pe-dir-filter":
+		if _, err := path.Match(value, ""); err != nil {
+			return fmt.Errorf("invalid glob in %s: %s", s, err)
+		}
+		parsed.Opts.Dir.Filters = append(parsed.Opts.Dir.Filters, value)
+	case "--pe-no-cache":
+		parsed.Opts.NoCache = true
+	case "--pe-no-store":
+		parsed.Opts.NoStore = true
+	case "--pe-refresh":
+		parsed.Opts.Refresh = true
+	case "--pe-ttl":
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid duration in %s", s)
+		}
+		parsed.Opts.TTL = ttl
+	case "--pe-non-interactive":
+		parsed.Opts.NonInteractive = true
+	case "--pe-cache-only":
+		parsed.Opts.CacheOnly = true
+	case "--pe-timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid duration in %s", s)
+		}
+		parsed.Opts.Timeout = timeout
+	default:
+		return fmt.Errorf("unknown pass-env option: %s", s)
+	}
+	return nil
+}
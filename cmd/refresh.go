@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/otard95/pass-env/config"
+	"github.com/otard95/pass-env/state"
+	"github.com/spf13/cobra"
+)
+
+var flag_allAliases bool
+
+// refreshCmd represents the refresh command
+var refreshCmd = &cobra.Command{
+	Use:   "refresh ALIAS|NAME=PASS_NAME...",
+	Short: "Refetch secrets and overwrite their cache entry",
+	Long: `Fetch the secrets for each alias, or for the given NAME=PASS_NAME pairs
+together, from the password store and overwrite their cache entries, without
+running a command. Aliases are refreshed in parallel.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		requireInitialized()
+		configureCache()
+
+		targets, err := cacheTargets(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if !runCacheTargets(targets, true) {
+			os.Exit(1)
+		}
+	},
+}
+
+// warmCmd represents the warm command
+var warmCmd = &cobra.Command{
+	Use:   "warm [ALIAS...]",
+	Short: "Cache the secrets of aliases that aren't cached yet",
+	Long: `Fetch and cache the secrets of each alias that doesn't have a valid cache
+entry, in parallel. Run it e.g. at login, while your smartcard is plugged in,
+so later runs hit the cache without prompting.`,
+	Example: `  pass-env warm --all-aliases`,
+	Run: func(cmd *cobra.Command, args []string) {
+		requireInitialized()
+		configureCache()
+
+		if flag_allAliases {
+			for alias := range config.Alieses {
+				args = append(args, alias)
+			}
+			slices.Sort(args)
+			args = slices.Compact(args)
+		}
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, "Error: no aliases given, pass some or use --all-aliases")
+			os.Exit(1)
+		}
+
+		for _, arg := range args {
+			if _, exists := config.Alieses[arg]; !exists {
+				fmt.Fprintf(os.Stderr, "Error: unknown alias '%s'\n", arg)
+				os.Exit(1)
+			}
+		}
+
+		targets, err := cacheTargets(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if !runCacheTargets(targets, false) {
+			os.Exit(1)
+		}
+	},
+}
+
+// cacheTarget is a set of secrets that share a cache entry
+type cacheTarget struct {
+	label  string
+	parsed *ParsedArgs
+}
+
+// cacheTargets makes a target of each alias in args, and one of the remaining
+// NAME=PASS_NAME pairs together
+func cacheTargets(args []string) ([]cacheTarget, error) {
+	var targets []cacheTarget
+	var pairs []string
+
+	for _, arg := range args {
+		if _, isAlias := config.Alieses[arg]; !isAlias {
+			pairs = append(pairs, arg)
+			continue
+		}
+		parsed, err := parseArgs([]string{arg})
+		if err != nil {
+			return nil, fmt.Errorf("alias '%s': %v", arg, err)
+		}
+		targets = append(targets, cacheTarget{label: arg, parsed: parsed})
+	}
+
+	if len(pairs) > 0 {
+		parsed, err := parseArgs(pairs)
+		if err != nil {
+			return nil, err
+		}
+		if len(parsed.Command) > 0 {
+			return nil, fmt.Errorf("'%s' is neither an alias nor a NAME=PASS_NAME pair", parsed.Command[0])
+		}
+		targets = append(targets, cacheTarget{label: strings.Join(pairs, " "), parsed: parsed})
+	}
+
+	return targets, nil
+}
+
+// runCacheTargets fetches and caches every target in parallel, skipping the
+// ones with a valid cache entry unless force is set, and reports how each
+// went. The first secret of each key is fetched before the rest, so a locked
+// key is only asked for once rather than by every target. Returns whether all
+// of them succeeded.
+func runCacheTargets(targets []cacheTarget, force bool) bool {
+	results := make([]string, len(targets))
+	failed := make([]bool, len(targets))
+
+	ctx, cancel := fetchContext(PassEnvOpts{})
+	defer cancel()
+
+	// Looking an entry up may need a passphrase too, so the lookups are done
+	// one at a time
+	var pending []int
+	var refs []string
+	for i, target := range targets {
+		if !force && isCached(ctx, target.parsed) {
+			results[i] = fmt.Sprintf("cached  %s", target.label)
+			continue
+		}
+		target.parsed.Opts.Refresh = true
+		pending = append(pending, i)
+		refs = append(refs, slices.Collect(maps.Values(target.parsed.SecretRequests()))...)
+	}
+
+	err := state.Unlock(ctx, refs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return false
+	}
+
+	var wg sync.WaitGroup
+	for _, i := range pending {
+		target := targets[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := fetchContext(target.parsed.Opts)
+			defer cancel()
+
+			_, _, err := loadSecrets(ctx, target.parsed)
+			if err != nil {
+				failed[i] = true
+				results[i] = fmt.Sprintf("failed  %s: %v", target.label, err)
+				return
+			}
+			results[i] = fmt.Sprintf("ok      %s", target.label)
+		}()
+	}
+
+	wg.Wait()
+
+	for _, result := range results {
+		fmt.Println(result)
+	}
+
+	return !slices.Contains(failed, true)
+}
+
+func init() {
+	warmCmd.Flags().BoolVarP(&flag_allAliases, "all-aliases", "a", false, "Warm the cache for every alias")
+	rootCmd.AddCommand(refreshCmd)
+	rootCmd.AddCommand(warmCmd)
+}
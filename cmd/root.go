@@ -20,12 +20,187 @@ var rootCmd = &cobra.Command{
 variables before executing a command.
 
 OPTIONS
-    Are the same as env(1), and must come before the envs
+    Are the same as env(1), and must come before the envs. Options starting
+    with --pe- belong to pass-env itself and are not passed on to env(1).
+    Alternatively, pass-env's options can be given before a --pass-env--
+    separator, with or without the --pe- prefix:
+
+        pass-env --no-cache --ttl=10m --pass-env-- -i TOKEN=github/token gh
+
+    --pe-no-cache
+        Neither read nor write the cache, always fetch the secrets
+
+    --pe-no-store
+        Use a cached entry if there is one, but don't cache fetched secrets
+
+    --pe-refresh
+        Ignore any cached entry, and replace it with freshly fetched secrets
+
+    --pe-ttl=DURATION
+        Let the cache entry written by this run expire after DURATION,
+        instead of the 'cache-ttl' from the config
+
+    --pe-timeout=DURATION
+        Give up fetching the secrets after DURATION, instead of the
+        'fetch-timeout' from the config
+
+    --pe-non-interactive
+        Never ask for a passphrase or pin. Secrets behind a locked key fail
+        with 'unlock required' instead. This is the default when there is
+        no terminal or display to ask on, e.g. in CI or cron jobs.
+
+    --pe-cache-only
+        Only use cached secrets, and fail if they aren't cached instead of
+        fetching them. The password store is never touched.
+
+    --pe-allow-argv-secrets
+        Allow {{pass:PASS_NAME}} placeholders in the command's arguments,
+        even when 'strict-argv-secrets' is enabled in the config
+
+    --pe-stdin=PASS_NAME
+        Same as the <PASS_NAME directive
+
+    --pe-from-dir=DIR
+        Set a variable for every entry under DIR in the password store,
+        named after the entry's base name. May be given more than once.
+        Explicit NAME=PASS_NAME pairs take precedence.
+
+    --pe-dir-upper
+        Uppercase the variable names of --pe-from-dir entries
+
+    --pe-dir-prefix=PREFIX
+        Prefix the variable names of --pe-from-dir entries, e.g. TF_VAR_
+
+    --pe-dir-filter=GLOB
+        Only use --pe-from-dir entries whose base name matches GLOB. May be
+        given more than once.
+
+SECRET SOURCES
+    PASS_NAME may start with a scheme saying where the secret comes from:
+
+        pass:NAME     the password store, the default without a scheme
+        passage:NAME  the passage store in $PASSAGE_DIR or ~/.passage/store,
+                      decrypted with the age identities in
+                      $PASSAGE_IDENTITIES_FILE or ~/.passage/identities
+        file:PATH     a plain file, e.g. file:/run/secrets/db_password
+        cmd:COMMAND   the output of a shell command, e.g.
+                      'cmd:op read op://vault/db/password'
+
+    As with pass entries, the first line is the secret and any 'key: value'
+    lines after it are metadata. --pe-from-dir accepts passage: and file:
+    directories too. Other sources can be added with state.RegisterSource.
+    If pass-env was initialized with a passage store, names without a scheme
+    are read from it.
+
+NAMED SECRETS
+    An @PASS_NAME token sets the variable named by the entry's own metadata,
+    a line like 'env: GITHUB_TOKEN' after the secret. Entries without one
+    get a name derived from the pass name, github/token becomes
+    GITHUB_TOKEN. Explicit NAME=PASS_NAME pairs take precedence.
+
+FILE DESCRIPTOR SECRETS
+    A NAME=fd:PASS_NAME pair keeps the secret out of the environment, where
+    it would be readable through /proc/<pid>/environ. The secret is written
+    to a pipe that the command inherits as an extra file descriptor, and
+    NAME_FD is set to its number, starting at 3. Read it from e.g.
+    /dev/fd/$NAME_FD.
+
+STDIN SECRETS
+    A <PASS_NAME directive among the pairs writes the secret, followed by a
+    newline, to the command's stdin and then closes it, instead of passing
+    through pass-env's own stdin. Remember to quote it, since '<' is a
+    redirection in most shells.
+
+ARGUMENT SECRETS
+    Some commands only accept credentials as arguments. Placeholders of the
+    form {{pass:PASS_NAME}} in the command's arguments are replaced with the
+    secret just before the command is executed. They only name entries of
+    the password store, never cmd: or file: references. Arguments are
+    visible to other users on the system, so a warning is printed unless the
+    --pe-allow-argv-secrets option is given. With 'strict-argv-secrets: true'
+    in ~/.config/pass-env/config the placeholders are refused unless the
+    option is given.
+
+CONFIG
+    Settings are read from 'key: value' lines in ~/.config/pass-env/config:
+
+    cache-ttl: DURATION
+        How long cached secrets stay valid, e.g. 12h. Unset means forever.
+
+    cache-scope: persistent|boot|session
+        Whether cached secrets survive a reboot, or the end of the login
+        session that cached them. Entries from another boot or session are
+        treated as misses and removed. Defaults to persistent.
+
+    cache-backend: pass|keyring|age|memory
+        Where cached secrets are kept. 'pass' encrypts them into pass-env's
+        own password store, so reading them back needs gpg. 'keyring' keeps
+        them in the Linux kernel keyring instead, where the kernel removes
+        them once their cache-ttl has passed, and they never touch the
+        disk. 'age' encrypts them into files with the age-identity.
+        'memory' keeps them only for the run itself, which disables the
+        cache. Defaults to pass.
+
+    keyring: user|session
+        The kernel keyring used by the keyring backend. The user keyring is
+        shared by all of your sessions until the last one ends, the session
+        keyring only by the processes of this login. Defaults to user.
+
+    age-identity: FILE
+        The age identity file used by the age backend, generated if it
+        doesn't exist. One in $XDG_RUNTIME_DIR makes the cache unreadable
+        once you log out. pass-env's index is encrypted with it too, if
+        pass-env was initialized without a gpg key. Defaults to
+        age-identity in pass-env's state directory.
+
+    agent-idle-timeout: DURATION
+        How long 'pass-env agent' waits for requests before it exits and
+        forgets the secrets it holds. 0 means never. Defaults to 1h.
+
+    direct-gpg: true|false
+        Decrypt pass entries, and the cache, with gpg directly instead of a
+        pass(1) process per secret. $PASSWORD_STORE_GPG_OPTS is honoured,
+        and pass is still used when PASSWORD_STORE_ENABLE_EXTENSIONS is
+        set or an entry isn't a .gpg file in the store. Defaults to true.
+
+    fetch-timeout: DURATION
+        How long fetching secrets may take, including waiting for a
+        passphrase or pin, before pass-env gives up and exits with 133.
+        0 means no limit. Defaults to 5m.
+
+    non-interactive: true|false
+        Whether to never ask for a passphrase or pin, see
+        --pe-non-interactive. Unset means only when there is no terminal or
+        display to ask on.
+
+    fetch-concurrency: N
+        How many secrets are decrypted at once. The first one is always
+        decrypted on its own, so a locked key prompts only once. Defaults
+        to 8.
+
+    never-cache: PATTERN...
+        Pass names, globs or prefixes that are never cached, e.g.
+        'never-cache: prod/root prod/admin/'. An entry can also opt out of
+        caching itself with a 'cache: never' line.
+
+    strict-argv-secrets: true
+        Refuse {{pass:PASS_NAME}} placeholders without --pe-allow-argv-secrets
 
 EXIT STATUS:
+   1      any other error
    128    invalid arguments
-   129    if secret is not found
-   -      the exit status of the env(1) command`,
+   129    a secret is not found
+   130    fetching was cancelled, by Ctrl-C or at a passphrase or pin prompt
+   131    a secret could not be decrypted
+   132    gpg, pass or another secret backend is unavailable
+   133    fetching the secrets timed out, see --pe-timeout
+   134    a key needs unlocking, but prompting is off, see --pe-non-interactive
+   135    the secrets aren't cached, with --pe-cache-only
+   -      the exit status of the env(1) command
+
+    Every secret that can't be fetched is reported. If they failed for
+    different reasons, the status is the first of 130, 133, 134, 132, 131
+    and 129 that applies.`,
 	Example: `  # Run Rails console with database password
   pass-env DB_PASSWORD=prod/database/password rails console
 
@@ -33,11 +208,32 @@ EXIT STATUS:
   pass-env TOKEN=github/token SLACK_KEY=slack/webhook ./deploy.sh
 
   # Pass through env options (-i to ignore inherited environment)
-  pass-env -i TOKEN=github/token gh pr view -c`,
+  pass-env -i TOKEN=github/token gh pr view -c
+
+  # Let the entry name its own variable with an 'env: GITHUB_TOKEN' line
+  pass-env @github/token gh pr view -c
+
+  # Set every entry under prod/billing, e.g. prod/billing/STRIPE_KEY
+  pass-env --pe-from-dir=prod/billing ./billing-service
+
+  # Hand a secret to the command over an inherited file descriptor
+  pass-env API_KEY=fd:prod/api-key sh -c 'exec ./server --key-file /dev/fd/$API_KEY_FD'
+
+  # Pipe a secret into the command's stdin
+  pass-env '<prod/registry' docker login --password-stdin registry.example.com
+
+  # Substitute a secret into the command's arguments
+  pass-env --pe-allow-argv-secrets mysql -u app '-p{{pass:prod/mysql}}'`,
 	Args:                  cobra.ArbitraryArgs,
 	DisableFlagParsing:    true,
 	DisableFlagsInUseLine: true,
 	Run: func(cmd *cobra.Command, args []string) {
+		// Flag parsing is left to parseArgs, so cobra doesn't see --help
+		if len(args) == 1 && (args[0] == "-h" || args[0] == "--help") {
+			cmd.Help()
+			return
+		}
+
 		parsed, err := parseArgs(args)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -50,45 +246,52 @@ EXIT STATUS:
 			os.Exit(128)
 		}
 
-		cacheKey := generateCacheKey(parsed.EnvPairs)
-
-		var envVars map[string]string
-		cached, hit := state.GetCache(cacheKey)
-		if hit {
-			envVars = cached
-		} else {
-			secrets, err := state.GetSecrets(parsed.EnvPairs)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-				os.Exit(129)
-			}
-			envVars = secrets
+		err = checkArgSecrets(parsed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(128)
+		}
 
-			err = state.SetCache(cacheKey, envVars)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: failed to cache secrets: %v\n", err)
-			}
+		if parsed.Opts.NonInteractive {
+			state.Interactive = false
+		}
+		if !parsed.Opts.NoCache {
+			configureCache()
+		}
 
-			passNames := make([]string, 0, len(parsed.EnvPairs))
-			for _, passName := range parsed.EnvPairs {
-				passNames = append(passNames, passName)
-			}
-			err = state.UpdateIndex(cacheKey, passNames)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: failed to update index: %v\n", err)
-			}
+		// Ctrl-C cancels fetching, but is left to the command once it runs
+		ctx, cancel := fetchContext(parsed.Opts)
+		secrets, _, err := loadSecrets(ctx, parsed)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(loadExitCode(err))
 		}
 
 		// Build env command args: [options...] NAME=value... command [args...]
 		envArgs := make([]string, 0)
 		envArgs = append(envArgs, parsed.EnvOpts...)
-		for name, value := range envVars {
-			envArgs = append(envArgs, fmt.Sprintf("%s=%s", name, value))
+		for name, value := range secrets {
+			if isEnvKey(name) {
+				envArgs = append(envArgs, fmt.Sprintf("%s=%s", name, value))
+			}
 		}
-		envArgs = append(envArgs, parsed.Command...)
+
+		fdFiles, fdEnvs, err := openSecretFds(parsed.FdPairs, secrets)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer closeFiles(fdFiles)
+		envArgs = append(envArgs, fdEnvs...)
+		envArgs = append(envArgs, substituteArgSecrets(parsed.Command, secrets)...)
 
 		execCmd := exec.Command("env", envArgs...)
+		execCmd.ExtraFiles = fdFiles
 		execCmd.Stdin = os.Stdin
+		if parsed.StdinSecret != "" {
+			execCmd.Stdin = strings.NewReader(secrets[stdinKey] + "\n")
+		}
 		execCmd.Stdout = os.Stdout
 		execCmd.Stderr = os.Stderr
 
@@ -103,6 +306,10 @@ EXIT STATUS:
 	},
 }
 
+func init() {
+	cobra.OnInitialize(configureAgeIdentity, configureFetch)
+}
+
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
@@ -112,12 +319,81 @@ func Execute() {
 
 type ParsedArgs struct {
 	EnvPairs map[string]string
-	Command  []string
-	EnvOpts  []string
+	// Pairs whose secret is delivered over a file descriptor, not the
+	// environment
+	FdPairs map[string]string
+	// Placeholders in Command mapped to the pass names that replace them
+	ArgSecrets map[string]string
+	// Pass names whose entries declare their own variable name
+	NamedSecrets []string
+	// The pass name of the secret written to the command's stdin
+	StdinSecret string
+	Command     []string
+	EnvOpts     []string
+	Opts        PassEnvOpts
+}
+
+// The request key of the secret written to the command's stdin
+const stdinKey = "<stdin>"
+
+// SecretRequests returns every secret the command needs, keyed by where it
+// is delivered: environment variable names, file descriptors, argument
+// placeholders and stdin
+func (p *ParsedArgs) SecretRequests() map[string]string {
+	requests := make(map[string]string, len(p.EnvPairs)+len(p.FdPairs)+len(p.ArgSecrets))
+	for name, passName := range p.EnvPairs {
+		requests[name] = passName
+	}
+	for name, passName := range p.FdPairs {
+		requests[fdKey(name)] = passName
+	}
+	for _, passName := range p.NamedSecrets {
+		requests[namedKey(passName)] = passName
+	}
+	for placeholder, passName := range p.ArgSecrets {
+		requests[placeholder] = passName
+	}
+	if p.StdinSecret != "" {
+		requests[stdinKey] = p.StdinSecret
+	}
+	return requests
+}
+
+// isEnvKey reports whether a request key, once resolved, is the name of an
+// environment variable rather than one of the other ways to deliver a secret
+func isEnvKey(key string) bool {
+	return key != stdinKey &&
+		!isFdPassName(key) &&
+		!isNamedSecret(key) &&
+		!argSecretPattern.MatchString(key)
+}
+
+func (p *ParsedArgs) addPair(name, passName string) error {
+	if isFdPassName(passName) {
+		passName = strings.TrimPrefix(passName, fdPrefix)
+		if passName == "" {
+			return fmt.Errorf("empty pass name in fd pair: %s=%s", name, fdPrefix)
+		}
+		p.FdPairs[name] = passName
+		return nil
+	}
+	p.EnvPairs[name] = passName
+	return nil
 }
 
-func isCliFlag(s string) bool {
-	return strings.HasPrefix(s, "-")
+func isStdinDirective(s string) bool {
+	return strings.HasPrefix(s, "<")
+}
+
+func setStdinSecret(parsed *ParsedArgs, passName string) error {
+	if passName == "" {
+		return fmt.Errorf("empty pass name in stdin directive")
+	}
+	if parsed.StdinSecret != "" {
+		return fmt.Errorf("only one secret can be written to stdin, got '%s' and '%s'", parsed.StdinSecret, passName)
+	}
+	parsed.StdinSecret = passName
+	return nil
 }
 
 func parseEnvPair(s string) (name, passName string, err error) {
@@ -136,14 +412,20 @@ func parseEnvPair(s string) (name, passName string, err error) {
 
 func parseArgs(args []string) (*ParsedArgs, error) {
 	parsed := &ParsedArgs{
-		EnvPairs: make(map[string]string),
-		EnvOpts:  []string{},
-		Command:  []string{},
+		EnvPairs:   make(map[string]string),
+		FdPairs:    make(map[string]string),
+		ArgSecrets: make(map[string]string),
+		EnvOpts:    []string{},
+		Command:    []string{},
 	}
 
-	i := 0
-	for ; i < len(args) && isCliFlag(args[i]); i++ {
-		parsed.EnvOpts = append(parsed.EnvOpts, args[i])
+	i, err := parseOptions(args, parsed)
+	if err != nil {
+		return nil, err
+	}
+	err = checkOptions(parsed.Opts)
+	if err != nil {
+		return nil, err
 	}
 
 	for ; i < len(args); i++ {
@@ -153,7 +435,23 @@ func parseArgs(args []string) (*ParsedArgs, error) {
 				if err != nil {
 					return nil, err
 				}
-				parsed.EnvPairs[name] = passName
+				err = parsed.addPair(name, passName)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		} else if isNamedSecret(args[i]) {
+			passName := strings.TrimPrefix(args[i], namedPrefix)
+			if passName == "" {
+				return nil, fmt.Errorf("empty pass name in %s", args[i])
+			}
+			parsed.NamedSecrets = append(parsed.NamedSecrets, passName)
+			continue
+		} else if isStdinDirective(args[i]) {
+			err := setStdinSecret(parsed, strings.TrimPrefix(args[i], "<"))
+			if err != nil {
+				return nil, err
 			}
 			continue
 		} else if !state.IsEnvPair(args[i]) {
@@ -164,18 +462,27 @@ func parseArgs(args []string) (*ParsedArgs, error) {
 		if err != nil {
 			return nil, err
 		}
-		parsed.EnvPairs[name] = passName
+		err = parsed.addPair(name, passName)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if i < len(args) {
 		parsed.Command = args[i:]
+		parsed.ArgSecrets = findArgSecrets(parsed.Command)
+	}
+
+	err = addDirPairs(parsed)
+	if err != nil {
+		return nil, err
 	}
 
 	return parsed, nil
 }
 
 func validateParsedArgs(parsed *ParsedArgs) error {
-	if len(parsed.EnvPairs) == 0 {
+	if len(parsed.SecretRequests()) == 0 {
 		return fmt.Errorf("no NAME=PASS_NAME pairs provided")
 	}
 	if len(parsed.Command) == 0 {
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/otard95/pass-env/config"
+)
+
+func TestParseArgs(t *testing.T) {
+	oldAliases := config.Alieses
+	config.Alieses = map[string]string{"db": "DB=prod/db TOKEN=prod/token"}
+	t.Cleanup(func() { config.Alieses = oldAliases })
+
+	cases := []struct {
+		name       string
+		args       []string
+		env        map[string]string
+		fd         map[string]string
+		argSecrets map[string]string
+		named      []string
+		stdin      string
+		command    []string
+		envOpts    []string
+		opts       PassEnvOpts
+	}{
+		{
+			name:    "pairs and command",
+			args:    []string{"A=prod/a", "B=prod/b", "cmd", "arg"},
+			env:     map[string]string{"A": "prod/a", "B": "prod/b"},
+			command: []string{"cmd", "arg"},
+		},
+		{
+			name:    "pass-env option",
+			args:    []string{"--pe-no-cache", "--pe-ttl=1h", "A=prod/a", "cmd"},
+			env:     map[string]string{"A": "prod/a"},
+			command: []string{"cmd"},
+			opts:    PassEnvOpts{NoCache: true, TTL: time.Hour},
+		},
+		{
+			name:    "options before the separator",
+			args:    []string{"--no-cache", "-ttl=1h", "--pe-refresh", "--pass-env--", "A=prod/a", "cmd"},
+			env:     map[string]string{"A": "prod/a"},
+			command: []string{"cmd"},
+			opts:    PassEnvOpts{NoCache: true, Refresh: true, TTL: time.Hour},
+		},
+		{
+			name:    "env options after the separator",
+			args:    []string{"--no-store", "--pass-env--", "-i", "A=prod/a", "cmd"},
+			env:     map[string]string{"A": "prod/a"},
+			command: []string{"cmd"},
+			envOpts: []string{"-i"},
+			opts:    PassEnvOpts{NoStore: true},
+		},
+		{
+			name:    "separator in the command's arguments",
+			args:    []string{"A=prod/a", "cmd", "--no-cache", "--pass-env--", "arg"},
+			env:     map[string]string{"A": "prod/a"},
+			command: []string{"cmd", "--no-cache", "--pass-env--", "arg"},
+		},
+		{
+			name:    "env option with a value",
+			args:    []string{"-u", "HOME", "--chdir", "/tmp", "A=prod/a", "cmd"},
+			env:     map[string]string{"A": "prod/a"},
+			command: []string{"cmd"},
+			envOpts: []string{"-u", "HOME", "--chdir", "/tmp"},
+		},
+		{
+			name:    "value that looks like a pair",
+			args:    []string{"-u", "A=prod/a", "B=prod/b", "cmd"},
+			env:     map[string]string{"B": "prod/b"},
+			command: []string{"cmd"},
+			envOpts: []string{"-u", "A=prod/a"},
+		},
+		{
+			name:    "end of env options",
+			args:    []string{"-i", "--", "A=prod/a", "cmd"},
+			env:     map[string]string{"A": "prod/a"},
+			command: []string{"cmd"},
+			envOpts: []string{"-i", "--"},
+		},
+		{
+			name:    "alias",
+			args:    []string{"db", "A=prod/a", "cmd"},
+			env:     map[string]string{"A": "prod/a", "DB": "prod/db", "TOKEN": "prod/token"},
+			command: []string{"cmd"},
+		},
+		{
+			name:    "stdin",
+			args:    []string{"<prod/key", "cmd"},
+			stdin:   "prod/key",
+			command: []string{"cmd"},
+		},
+		{
+			name:    "stdin option",
+			args:    []string{"--pe-stdin=prod/key", "cmd"},
+			stdin:   "prod/key",
+			command: []string{"cmd"},
+		},
+		{
+			name:    "named secret",
+			args:    []string{"@prod/db", "@prod/token", "cmd"},
+			named:   []string{"prod/db", "prod/token"},
+			command: []string{"cmd"},
+		},
+		{
+			name:    "fd pair",
+			args:    []string{"DB=fd:prod/db", "A=prod/a", "cmd"},
+			env:     map[string]string{"A": "prod/a"},
+			fd:      map[string]string{"DB": "prod/db"},
+			command: []string{"cmd"},
+		},
+		{
+			name:       "argument placeholder",
+			args:       []string{"curl", "-H", "Authorization: {{pass:prod/token}}", "{{pass:prod/url}}"},
+			argSecrets: map[string]string{"{{pass:prod/token}}": "prod/token", "{{pass:prod/url}}": "prod/url"},
+			command:    []string{"curl", "-H", "Authorization: {{pass:prod/token}}", "{{pass:prod/url}}"},
+		},
+		{
+			name:    "pair after the command",
+			args:    []string{"A=prod/a", "cmd", "B=prod/b"},
+			env:     map[string]string{"A": "prod/a"},
+			command: []string{"cmd", "B=prod/b"},
+		},
+	}
+
+	for _, c := range cases {
+		parsed, err := parseArgs(c.args)
+		if err != nil {
+			t.Errorf("%s: parseArgs(%q) failed: %v", c.name, c.args, err)
+			continue
+		}
+
+		if !maps.Equal(parsed.EnvPairs, c.env) {
+			t.Errorf("%s: expected env pairs %v, got %v", c.name, c.env, parsed.EnvPairs)
+		}
+		if !maps.Equal(parsed.FdPairs, c.fd) {
+			t.Errorf("%s: expected fd pairs %v, got %v", c.name, c.fd, parsed.FdPairs)
+		}
+		if !maps.Equal(parsed.ArgSecrets, c.argSecrets) {
+			t.Errorf("%s: expected argument secrets %v, got %v", c.name, c.argSecrets, parsed.ArgSecrets)
+		}
+		if !slices.Equal(parsed.NamedSecrets, c.named) {
+			t.Errorf("%s: expected named secrets %v, got %v", c.name, c.named, parsed.NamedSecrets)
+		}
+		if parsed.StdinSecret != c.stdin {
+			t.Errorf("%s: expected stdin secret %q, got %q", c.name, c.stdin, parsed.StdinSecret)
+		}
+		if !slices.Equal(parsed.Command, c.command) {
+			t.Errorf("%s: expected command %q, got %q", c.name, c.command, parsed.Command)
+		}
+		if !slices.Equal(parsed.EnvOpts, c.envOpts) {
+			t.Errorf("%s: expected env options %q, got %q", c.name, c.envOpts, parsed.EnvOpts)
+		}
+		if parsed.Opts.NoCache != c.opts.NoCache || parsed.Opts.NoStore != c.opts.NoStore ||
+			parsed.Opts.Refresh != c.opts.Refresh || parsed.Opts.TTL != c.opts.TTL {
+			t.Errorf("%s: expected options %+v, got %+v", c.name, c.opts, parsed.Opts)
+		}
+	}
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+	}{
+		{"unknown option before the separator", []string{"--bogus", "--pass-env--", "A=prod/a", "cmd"}},
+		{"env option without its value", []string{"-u"}},
+		{"empty pass name", []string{"A=fd:", "cmd"}},
+		{"two stdin secrets", []string{"<prod/a", "<prod/b", "cmd"}},
+		{"empty named secret", []string{"@", "cmd"}},
+		{"contradicting options", []string{"--pe-cache-only", "--pe-no-cache", "A=prod/a", "cmd"}},
+		{"invalid ttl", []string{"--pe-ttl=soon", "A=prod/a", "cmd"}},
+	}
+
+	for _, c := range cases {
+		if _, err := parseArgs(c.args); err == nil {
+			t.Errorf("%s: expected parseArgs(%q) to fail", c.name, c.args)
+		}
+	}
+}
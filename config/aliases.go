@@ -19,7 +19,7 @@ var (
 )
 
 func Save() {
-	aliasesFile, err := getFile()
+	aliasesFile, err := getFile("aliases")
 	if err != nil {
 		fmt.Printf("%e", err)
 		os.Exit(1)
@@ -44,23 +44,25 @@ func Save() {
 	}
 }
 
-func getFile() (string, error) {
+func getFile(name string) (string, error) {
 	configDir, err := os.UserConfigDir()
 	if err != nil {
 		return "", fmt.Errorf("Unable to resolve config dir: %e", err)
 	}
 
-	return path.Join(configDir, "pass-env", "aliases"), nil
+	return path.Join(configDir, "pass-env", name), nil
 }
 
 func init() {
+	loadSettings()
+
 	defer func() {
 		if Alieses == nil {
 			Alieses = make(aliases)
 		}
 	}()
 
-	aliasesFile, err := getFile()
+	aliasesFile, err := getFile("aliases")
 	if err != nil {
 		fmt.Printf("%e", err)
 		os.Exit(1)
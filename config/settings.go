@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/otard95/pass-env/lib/fs"
+)
+
+type settings map[string]string
+
+// Settings holds the 'key: value' pairs from the pass-env config file
+var Settings settings
+
+// String returns the setting for key, or fallback if it is not set
+func (s settings) String(key, fallback string) string {
+	if value, ok := s[key]; ok {
+		return value
+	}
+	return fallback
+}
+
+// Bool reports whether the setting for key is set to a truthy value
+func (s settings) Bool(key string) bool {
+	switch strings.ToLower(s[key]) {
+	case "true", "yes", "on", "1":
+		return true
+	}
+	return false
+}
+
+// List returns the whitespace separated values of the setting for key
+func (s settings) List(key string) []string {
+	return strings.Fields(s[key])
+}
+
+// Int returns the setting for key parsed as an integer, or fallback if it is
+// not set. Invalid integers are reported and ignored.
+func (s settings) Int(key string, fallback int) int {
+	value, ok := s[key]
+	if !ok {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Printf("WARN: Invalid number for '%s' in config: %s\n", key, value)
+		return fallback
+	}
+	return n
+}
+
+// Duration returns the setting for key parsed as a duration, or fallback if
+// it is not set. Invalid durations are reported and ignored.
+func (s settings) Duration(key string, fallback time.Duration) time.Duration {
+	value, ok := s[key]
+	if !ok {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Printf("WARN: Invalid duration for '%s' in config: %s\n", key, value)
+		return fallback
+	}
+	return duration
+}
+
+func loadSettings() {
+	defer func() {
+		if Settings == nil {
+			Settings = make(settings)
+		}
+	}()
+
+	settingsFile, err := getFile("config")
+	if err != nil {
+		fmt.Printf("%e", err)
+		os.Exit(1)
+	}
+
+	if !fs.IsFile(settingsFile) {
+		return
+	}
+
+	content, err := os.ReadFile(settingsFile)
+	if err != nil {
+		fmt.Printf("Unable to read config file: %e\n", err)
+		os.Exit(1)
+	}
+
+	Settings = make(settings, strings.Count(string(content), "\n")+1)
+
+	for line := range strings.Lines(string(content)) {
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 {
+			fmt.Printf("WARN: Invalid config line in '%s':\n  %s\n", settingsFile, line)
+			continue
+		}
+
+		Settings[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+}
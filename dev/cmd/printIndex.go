@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -13,7 +14,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	index := state.Index()
+	index := state.Index(context.Background())
 
 	if len(index) == 0 {
 		fmt.Println("Index is empty (no entries)")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -20,7 +21,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	cached, hit := state.GetCache(hash)
+	cached, hit := state.GetCache(context.Background(), hash)
 	if !hit {
 		fmt.Printf("Cache miss for hash: %s\n", hash)
 		os.Exit(1)
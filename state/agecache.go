@@ -0,0 +1,192 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/otard95/pass-env/lib/fs"
+)
+
+// ageBackend keeps entries as files encrypted with age, so reading them back
+// needs an identity file rather than gpg
+type ageBackend struct {
+	identities []age.Identity
+	recipients []age.Recipient
+}
+
+// AgeStore returns the directory the age backend keeps its entries in
+func AgeStore() string {
+	return path.Join(Path, "age-store")
+}
+
+// AgeIdentity is the identity file the age backend encrypts with, and the
+// index too if pass-env was initialized without a gpg key
+var AgeIdentity string
+
+// DefaultAgeIdentity is the identity file used when none is configured
+func DefaultAgeIdentity() string {
+	return path.Join(Path, "age-identity")
+}
+
+// NewAgeBackend returns a backend that encrypts entries to the X25519
+// identities in identityFile. A new identity is generated if the file doesn't
+// exist, e.g. one in $XDG_RUNTIME_DIR makes the cache unreadable once the
+// user logs out.
+func NewAgeBackend(identityFile string) (CacheBackend, error) {
+	return newAgeBackend(identityFile)
+}
+
+func newAgeBackend(identityFile string) (ageBackend, error) {
+	if identityFile == "" {
+		return ageBackend{}, errors.New("the age cache backend needs an identity file")
+	}
+
+	if !fs.IsFile(identityFile) {
+		err := generateAgeIdentity(identityFile)
+		if err != nil {
+			return ageBackend{}, fmt.Errorf("failed to create age identity '%s': %s", identityFile, err)
+		}
+	}
+
+	content, err := os.ReadFile(identityFile)
+	if err != nil {
+		return ageBackend{}, fmt.Errorf("failed to read age identity: %s", err)
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(content))
+	if err != nil {
+		return ageBackend{}, fmt.Errorf("failed to parse age identity '%s': %s", identityFile, err)
+	}
+
+	backend := ageBackend{identities: identities}
+	for _, identity := range identities {
+		if x25519, ok := identity.(*age.X25519Identity); ok {
+			backend.recipients = append(backend.recipients, x25519.Recipient())
+		}
+	}
+	if len(backend.recipients) == 0 {
+		return ageBackend{}, fmt.Errorf("no X25519 identity in '%s' to encrypt to", identityFile)
+	}
+
+	return backend, nil
+}
+
+func generateAgeIdentity(identityFile string) error {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(identityFile), 0700)
+	if err != nil {
+		return err
+	}
+
+	content := fmt.Sprintf(
+		"# created: %s\n# public key: %s\n%s\n",
+		time.Now().Format(time.RFC3339), identity.Recipient(), identity,
+	)
+	return fs.WriteFileAtomic(identityFile, []byte(content), 0600)
+}
+
+func (ageBackend) entryFile(hash string) string {
+	return filepath.Join(AgeStore(), filepath.FromSlash(hash)+".age")
+}
+
+func (b ageBackend) encrypt(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := age.Encrypt(&buffer, b.recipients...)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (b ageBackend) decrypt(data []byte) ([]byte, error) {
+	reader, err := age.Decrypt(bytes.NewReader(data), b.identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+func (b ageBackend) Get(ctx context.Context, hash string) ([]byte, error) {
+	data, err := os.ReadFile(b.entryFile(hash))
+	if err != nil {
+		return nil, err
+	}
+	return b.decrypt(data)
+}
+
+func (b ageBackend) Set(ctx context.Context, hash string, data []byte, ttl time.Duration) error {
+	encrypted, err := b.encrypt(data)
+	if err != nil {
+		return err
+	}
+
+	entryFile := b.entryFile(hash)
+	err = os.MkdirAll(filepath.Dir(entryFile), 0700)
+	if err != nil {
+		return err
+	}
+	return fs.WriteFileAtomic(entryFile, encrypted, 0600)
+}
+
+func (b ageBackend) Delete(ctx context.Context, hash string) error {
+	err := os.Remove(b.entryFile(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (ageBackend) List() ([]string, error) {
+	if !fs.IsDir(AgeStore()) {
+		return nil, nil
+	}
+
+	var hashes []string
+	err := filepath.WalkDir(AgeStore(), func(p string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".age") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(AgeStore(), p)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, strings.TrimSuffix(filepath.ToSlash(rel), ".age"))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache entries in '%s': %s", AgeStore(), err)
+	}
+
+	return hashes, nil
+}
+
+func (b ageBackend) Metadata(hash string) (CacheMetadata, error) {
+	stat, err := os.Stat(b.entryFile(hash))
+	if err != nil {
+		return CacheMetadata{}, err
+	}
+	return CacheMetadata{Modified: stat.ModTime(), Size: int(stat.Size())}, nil
+}
@@ -0,0 +1,132 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CacheBackend is where cache entries are kept, as encoded bytes under their
+// hash
+type CacheBackend interface {
+	// Get returns the entry for hash. Backends that have to decrypt it give
+	// up once ctx is done.
+	Get(ctx context.Context, hash string) ([]byte, error)
+	// Set stores data under hash, replacing any existing entry. Backends that
+	// can drop the entry themselves once ttl has passed, zero means never.
+	Set(ctx context.Context, hash string, data []byte, ttl time.Duration) error
+	// Delete removes the entry for hash, if there is one
+	Delete(ctx context.Context, hash string) error
+	List() ([]string, error)
+	Metadata(hash string) (CacheMetadata, error)
+}
+
+// CacheMetadata is what a backend knows about an entry without decoding it
+type CacheMetadata struct {
+	// When the entry was last written
+	Modified time.Time
+	Size     int
+}
+
+// The kernel keyrings the keyring backend can keep entries in
+const (
+	KeyringUser    = "user"
+	KeyringSession = "session"
+)
+
+var cacheBackend CacheBackend = NewPassBackend()
+
+// SetCacheBackend selects where cache entries are kept
+func SetCacheBackend(backend CacheBackend) {
+	cacheBackend = backend
+}
+
+// volatileBackend is implemented by backends whose entries don't outlive the
+// process
+type volatileBackend interface {
+	Volatile() bool
+}
+
+// CachePersists reports whether the selected backend keeps entries beyond
+// this process. Entries that don't aren't indexed, nor is their use recorded.
+func CachePersists() bool {
+	volatile, ok := cacheBackend.(volatileBackend)
+	return !ok || !volatile.Volatile()
+}
+
+// memoryBackend keeps entries in the memory of the current process, so
+// nothing outlives it
+type memoryBackend struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	written map[string]time.Time
+}
+
+var errNoEntry = errors.New("no such cache entry")
+
+// NewMemoryBackend returns a backend that keeps entries only for as long as
+// the process runs. Since every pass-env run is a process of its own, this
+// effectively disables caching.
+func NewMemoryBackend() CacheBackend {
+	return &memoryBackend{
+		entries: make(map[string][]byte),
+		written: make(map[string]time.Time),
+	}
+}
+
+func (b *memoryBackend) Volatile() bool {
+	return true
+}
+
+func (b *memoryBackend) Get(ctx context.Context, hash string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, exists := b.entries[hash]
+	if !exists {
+		return nil, errNoEntry
+	}
+	return data, nil
+}
+
+func (b *memoryBackend) Set(ctx context.Context, hash string, data []byte, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries[hash] = data
+	b.written[hash] = time.Now()
+	return nil
+}
+
+func (b *memoryBackend) Delete(ctx context.Context, hash string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.entries, hash)
+	delete(b.written, hash)
+	return nil
+}
+
+func (b *memoryBackend) List() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hashes := make([]string, 0, len(b.entries))
+	for hash := range b.entries {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func (b *memoryBackend) Metadata(hash string) (CacheMetadata, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, exists := b.entries[hash]
+	if !exists {
+		return CacheMetadata{}, fmt.Errorf("%w '%s'", errNoEntry, hash)
+	}
+	return CacheMetadata{Modified: b.written[hash], Size: len(data)}, nil
+}
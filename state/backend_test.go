@@ -0,0 +1,134 @@
+package state
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// forEachBackend runs test against every cache backend available here, each
+// in a fresh state directory
+func forEachBackend(t *testing.T, test func(t *testing.T)) {
+	backends := []struct {
+		name  string
+		setup func(t *testing.T) CacheBackend
+	}{
+		{"pass", func(t *testing.T) CacheBackend {
+			_, cleanup := setupTestEnv(t)
+			t.Cleanup(cleanup)
+			return NewPassBackend()
+		}},
+		{"keyring", setupKeyring},
+		{"memory", func(t *testing.T) CacheBackend {
+			return NewMemoryBackend()
+		}},
+		{"age", func(t *testing.T) CacheBackend {
+			backend, err := NewAgeBackend(filepath.Join(t.TempDir(), "identity"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return backend
+		}},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			oldPath, oldBackend, oldIndex := Path, cacheBackend, index
+			t.Cleanup(func() { Path, cacheBackend, index = oldPath, oldBackend, oldIndex })
+
+			Path = t.TempDir()
+			index = make(passNameDependents)
+			SetCacheBackend(backend.setup(t))
+
+			test(t)
+		})
+	}
+}
+
+func TestCacheBackends(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		before := time.Now().Add(-time.Second)
+
+		if err := cacheBackend.Set(context.Background(), "abc", []byte("data"), 0); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+		if err := cacheBackend.Set(context.Background(), "abc", []byte("replaced"), 0); err != nil {
+			t.Fatalf("Set failed to replace: %v", err)
+		}
+
+		data, err := cacheBackend.Get(context.Background(), "abc")
+		if err != nil || string(data) != "replaced" {
+			t.Errorf("Expected 'replaced', got %q %v", data, err)
+		}
+
+		hashes, err := cacheBackend.List()
+		if err != nil || !slices.Contains(hashes, "abc") {
+			t.Errorf("Expected abc in %v %v", hashes, err)
+		}
+
+		if meta, err := cacheBackend.Metadata("abc"); err == nil && meta.Modified.Before(before) {
+			t.Errorf("Expected a recent modification time, got %v", meta.Modified)
+		}
+
+		if err := cacheBackend.Delete(context.Background(), "abc"); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		if _, err := cacheBackend.Get(context.Background(), "abc"); err == nil {
+			t.Error("Expected Get to fail after Delete")
+		}
+		if err := cacheBackend.Delete(context.Background(), "abc"); err != nil {
+			t.Errorf("Deleting a missing entry failed: %v", err)
+		}
+	})
+}
+
+func TestCacheEntryAcrossBackends(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		entry := NewCacheEntry(map[string]string{"TOKEN": "secret"}, map[string]string{"TOKEN": "github/token"})
+		entry.TTL = time.Hour
+		if err := SetCacheEntry(context.Background(), "abc", entry); err != nil {
+			t.Fatalf("SetCacheEntry failed: %v", err)
+		}
+
+		if !isRecentEntry("abc") {
+			t.Error("Expected the entry to be recent")
+		}
+
+		selected, err := SelectCache(context.Background(), CacheSelector{Vars: []string{"TOKEN"}})
+		if err != nil || len(selected) != 1 {
+			t.Fatalf("Expected to select the entry, got %v %v", selected, err)
+		}
+
+		if err := Clear(context.Background(), "abc"); err != nil {
+			t.Fatalf("Clear failed: %v", err)
+		}
+		if _, hit := GetCacheEntry(context.Background(), "abc"); hit {
+			t.Error("Expected cache miss after clear")
+		}
+	})
+}
+
+func TestVolatileBackendSkipsBookkeeping(t *testing.T) {
+	oldPath, oldBackend := Path, cacheBackend
+	t.Cleanup(func() { Path, cacheBackend = oldPath, oldBackend })
+	Path = t.TempDir()
+	SetCacheBackend(NewMemoryBackend())
+
+	if CachePersists() {
+		t.Fatal("Expected the memory backend not to persist")
+	}
+	if err := UpdateIndex(context.Background(), "abc", []string{"prod/db"}); err != nil {
+		t.Errorf("UpdateIndex failed: %v", err)
+	}
+	if err := TouchCache("abc"); err != nil {
+		t.Errorf("TouchCache failed: %v", err)
+	}
+
+	files, _ := os.ReadDir(Path)
+	if len(files) != 0 {
+		t.Errorf("Expected nothing written for a volatile backend, got %v", files)
+	}
+}
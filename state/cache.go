@@ -0,0 +1,234 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// Version is the pass-env version recorded in the cache entries it writes,
+// set at build time with -ldflags "-X github.com/otard95/pass-env/state.Version=..."
+var Version = "dev"
+
+// The version of the cache entry format written by SetCacheEntry. Entries
+// with a newer version are treated as cache misses.
+const cacheFormatVersion = 3
+
+// Marks a versioned cache entry. Legacy entries are a bare gob-encoded map.
+var cacheMagic = []byte("pass-env-cache\n")
+
+// CacheEntry is a cached bundle of secrets along with what produced it
+type CacheEntry struct {
+	Version   int
+	WrittenBy string
+	Created   time.Time
+	// How long the entry is valid for, zero means it never expires
+	TTL time.Duration
+	// The requests the entry covers, e.g. NAME -> PASS_NAME
+	Selectors map[string]string
+	PassNames []string
+	// The sha256 of each pass name's encrypted file when it was cached
+	Fingerprints map[string]string
+	Values       map[string]string
+	// Requests that must never be cached, fetched again on every hit
+	Uncached map[string]string
+	// The variables of Values set by @PASS_NAME requests, NAME -> PASS_NAME
+	Named map[string]string
+	// The boot and login session the entry is only valid in, if any
+	BootID    string
+	SessionID string
+
+	legacy bool
+}
+
+// NewCacheEntry creates an entry for values, fetched for the given requests
+func NewCacheEntry(values, selectors map[string]string) *CacheEntry {
+	entry := &CacheEntry{
+		Selectors:    selectors,
+		Fingerprints: make(map[string]string),
+		Values:       values,
+	}
+
+	for _, passName := range selectors {
+		if slices.Contains(entry.PassNames, passName) {
+			continue
+		}
+		entry.PassNames = append(entry.PassNames, passName)
+		if fingerprint, err := fingerprint(passName); err == nil {
+			entry.Fingerprints[passName] = fingerprint
+		}
+	}
+	slices.Sort(entry.PassNames)
+
+	return entry
+}
+
+// IsLegacy reports whether the entry was read from the unversioned format,
+// which holds nothing but the values
+func (e *CacheEntry) IsLegacy() bool {
+	return e.legacy
+}
+
+func (e *CacheEntry) Expired(now time.Time) bool {
+	return e.TTL > 0 && now.After(e.Created.Add(e.TTL))
+}
+
+// remainingTTL is how long the backend should keep the entry around: until it
+// expires, or forever if it doesn't
+func (e *CacheEntry) remainingTTL(now time.Time) time.Duration {
+	if e.TTL <= 0 {
+		return 0
+	}
+	return max(e.Created.Add(e.TTL).Sub(now), time.Second)
+}
+
+func encodeCacheEntry(entry *CacheEntry) ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.Write(cacheMagic)
+
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func decodeCacheEntry(data []byte) (*CacheEntry, error) {
+	if !bytes.HasPrefix(data, cacheMagic) {
+		values := make(map[string]string)
+		decoder := gob.NewDecoder(bytes.NewBuffer(data))
+		err := decoder.Decode(&values)
+		if err != nil {
+			return nil, err
+		}
+		return &CacheEntry{Values: values, legacy: true}, nil
+	}
+
+	entry := &CacheEntry{}
+	decoder := gob.NewDecoder(bytes.NewBuffer(data[len(cacheMagic):]))
+	err := decoder.Decode(entry)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Version > cacheFormatVersion {
+		return nil, fmt.Errorf(
+			"cache entry format %d was written by a newer pass-env (%s)",
+			entry.Version, entry.WrittenBy,
+		)
+	}
+
+	return entry, nil
+}
+
+// ReadCacheEntry reads the cache entry for a given hash, whether it has
+// expired or not
+func ReadCacheEntry(ctx context.Context, hash string) (*CacheEntry, error) {
+	out, err := cacheBackend.Get(ctx, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache entry '%s': %s", hash, err)
+	}
+
+	entry, err := decodeCacheEntry(out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode cache entry '%s': %s", hash, err)
+	}
+
+	return entry, nil
+}
+
+// GetCacheEntry retrieves the cache entry for a given hash, and a boolean
+// indicating cache hit. Expired entries are misses, and so are entries from
+// another boot or login session, which are removed as well.
+func GetCacheEntry(ctx context.Context, hash string) (*CacheEntry, bool) {
+	entry, err := ReadCacheEntry(ctx, hash)
+	if err != nil {
+		return nil, false
+	}
+
+	if entry.Expired(time.Now()) {
+		return nil, false
+	}
+
+	if !entry.InScope() {
+		if Clear(ctx, hash) == nil {
+			RemoveHashesFromIndex(ctx, hash)
+		}
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// ListCache returns the hashes of every entry in the cache backend
+func ListCache() ([]string, error) {
+	hashes, err := cacheBackend.List()
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(hashes)
+	return hashes, nil
+}
+
+// GetCache retrieves cached environment variables for a given hash.
+// Returns the cached env vars as a map (NAME -> value) and a boolean indicating cache hit.
+func GetCache(ctx context.Context, hash string) (map[string]string, bool) {
+	entry, hit := GetCacheEntry(ctx, hash)
+	if !hit {
+		return nil, false
+	}
+	return entry.Values, true
+}
+
+// SetCacheEntry stores entry under hash in the current format, replacing
+// any existing entry
+func SetCacheEntry(ctx context.Context, hash string, entry *CacheEntry) error {
+	entry.Version = cacheFormatVersion
+	entry.WrittenBy = Version
+	if entry.Created.IsZero() {
+		entry.Created = time.Now()
+	}
+
+	data, err := encodeCacheEntry(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache data: %s", err)
+	}
+
+	err = cacheBackend.Set(ctx, hash, data, entry.remainingTTL(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to store cache entry '%s': %s", hash, err)
+	}
+
+	return nil
+}
+
+// SetCache stores envVars under hash without any request metadata
+func SetCache(ctx context.Context, hash string, envVars map[string]string) error {
+	return SetCacheEntry(ctx, hash, NewCacheEntry(envVars, nil))
+}
+
+// fingerprint identifies the current version of a secret without decrypting
+// it. Only sources that keep encrypted files, like the pass store, have one.
+func fingerprint(ref string) (string, error) {
+	source, name := sourceOf(ref)
+	if fingerprinter, ok := source.(fingerprinter); ok {
+		return fingerprinter.Fingerprint(name)
+	}
+	return "", fmt.Errorf("secrets from '%s' have no fingerprint", ref)
+}
+
+// fileFingerprint hashes the content of an encrypted file
+func fileFingerprint(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
@@ -1,9 +1,14 @@
 package state
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"os"
 	"os/exec"
+	"slices"
 	"testing"
+	"time"
 )
 
 func setupTestEnv(t *testing.T) (string, func()) {
@@ -61,22 +66,22 @@ func setupTestEnv(t *testing.T) (string, func()) {
 }
 
 func TestGetCacheMiss(t *testing.T) {
-	_, cleanup := setupTestEnv(t)
-	defer cleanup()
-
-	cached, hit := GetCache("nonexistent-hash")
-	if hit {
-		t.Errorf("Expected cache miss, got hit with data: %v", cached)
-	}
-	if cached != nil {
-		t.Errorf("Expected nil for cache miss, got: %v", cached)
-	}
+	forEachBackend(t, func(t *testing.T) {
+		cached, hit := GetCache(context.Background(), "nonexistent-hash")
+		if hit {
+			t.Errorf("Expected cache miss, got hit with data: %v", cached)
+		}
+		if cached != nil {
+			t.Errorf("Expected nil for cache miss, got: %v", cached)
+		}
+	})
 }
 
 func TestSetAndGetCache(t *testing.T) {
-	_, cleanup := setupTestEnv(t)
-	defer cleanup()
+	forEachBackend(t, testSetAndGetCache)
+}
 
+func testSetAndGetCache(t *testing.T) {
 	hash := "test-hash-123"
 	testData := map[string]string{
 		"API_KEY":     "secret-value",
@@ -85,13 +90,13 @@ func TestSetAndGetCache(t *testing.T) {
 	}
 
 	// Set cache
-	err := SetCache(hash, testData)
+	err := SetCache(context.Background(), hash, testData)
 	if err != nil {
 		t.Fatalf("SetCache failed: %v", err)
 	}
 
 	// Get cache
-	cached, hit := GetCache(hash)
+	cached, hit := GetCache(context.Background(), hash)
 	if !hit {
 		t.Logf("Store path: %s", Store())
 		t.Fatal("Expected cache hit, got miss")
@@ -120,13 +125,13 @@ func TestUpdateIndex(t *testing.T) {
 	passNames := []string{"services/api-key", "prod/db", "github/token"}
 
 	// Update index
-	err := UpdateIndex(hash, passNames)
+	err := UpdateIndex(context.Background(), hash, passNames)
 	if err != nil {
 		t.Fatalf("UpdateIndex failed: %v", err)
 	}
 
 	// Verify index
-	dependents := GetDependents(passNames...)
+	dependents := GetDependents(context.Background(), passNames...)
 	found := false
 	for _, dep := range dependents {
 		if dep == hash {
@@ -139,3 +144,88 @@ func TestUpdateIndex(t *testing.T) {
 		t.Errorf("Hash '%s' not found in dependents: %v", hash, dependents)
 	}
 }
+
+func TestDecodeLegacyCacheEntry(t *testing.T) {
+	var buffer bytes.Buffer
+	values := map[string]string{"API_KEY": "secret-value"}
+	if err := gob.NewEncoder(&buffer).Encode(values); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := decodeCacheEntry(buffer.Bytes())
+	if err != nil {
+		t.Fatalf("decodeCacheEntry failed: %v", err)
+	}
+	if !entry.IsLegacy() {
+		t.Error("Expected legacy entry")
+	}
+	if entry.Values["API_KEY"] != "secret-value" {
+		t.Errorf("Expected API_KEY 'secret-value', got '%s'", entry.Values["API_KEY"])
+	}
+}
+
+func TestEncodeDecodeCacheEntry(t *testing.T) {
+	entry := NewCacheEntry(
+		map[string]string{"API_KEY": "secret-value", "DB": "super-secret"},
+		map[string]string{"API_KEY": "services/api-key", "DB": "prod/db"},
+	)
+	entry.Version = cacheFormatVersion
+	entry.Created = time.Now().Truncate(time.Second)
+	entry.TTL = time.Hour
+
+	data, err := encodeCacheEntry(entry)
+	if err != nil {
+		t.Fatalf("encodeCacheEntry failed: %v", err)
+	}
+
+	decoded, err := decodeCacheEntry(data)
+	if err != nil {
+		t.Fatalf("decodeCacheEntry failed: %v", err)
+	}
+	if decoded.IsLegacy() {
+		t.Error("Expected versioned entry")
+	}
+	if !decoded.Created.Equal(entry.Created) || decoded.TTL != entry.TTL {
+		t.Errorf("Metadata mismatch: expected %v/%v, got %v/%v", entry.Created, entry.TTL, decoded.Created, decoded.TTL)
+	}
+	if !slices.Equal(decoded.PassNames, []string{"prod/db", "services/api-key"}) {
+		t.Errorf("Unexpected pass names: %v", decoded.PassNames)
+	}
+	if decoded.Selectors["DB"] != "prod/db" || decoded.Values["DB"] != "super-secret" {
+		t.Errorf("Unexpected selectors or values: %v %v", decoded.Selectors, decoded.Values)
+	}
+}
+
+func TestDecodeNewerCacheEntry(t *testing.T) {
+	entry := NewCacheEntry(map[string]string{"API_KEY": "secret-value"}, nil)
+	entry.Version = cacheFormatVersion + 1
+
+	data, err := encodeCacheEntry(entry)
+	if err != nil {
+		t.Fatalf("encodeCacheEntry failed: %v", err)
+	}
+
+	_, err = decodeCacheEntry(data)
+	if err == nil {
+		t.Error("Expected entries from a newer format to be rejected")
+	}
+}
+
+func TestCacheEntryExpired(t *testing.T) {
+	now := time.Now()
+	entry := &CacheEntry{Created: now.Add(-2 * time.Hour)}
+
+	if entry.Expired(now) {
+		t.Error("Entries without TTL should never expire")
+	}
+
+	entry.TTL = time.Hour
+	if !entry.Expired(now) {
+		t.Error("Expected entry to be expired")
+	}
+
+	entry.TTL = 3 * time.Hour
+	if entry.Expired(now) {
+		t.Error("Expected entry to still be valid")
+	}
+}
@@ -0,0 +1,42 @@
+package state
+
+import "strings"
+
+// Secret is a decrypted pass entry
+type Secret struct {
+	// The first line of the entry
+	Value string
+	// The 'key: value' lines following the first line, with lowercased keys
+	Meta map[string]string
+}
+
+// parseEntry splits the output of 'pass show' into the secret and its
+// metadata lines
+func parseEntry(content string) Secret {
+	lines := strings.Split(content, "\n")
+	secret := Secret{
+		Value: strings.TrimSpace(lines[0]),
+		Meta:  make(map[string]string),
+	}
+
+	for _, line := range lines[1:] {
+		key, value, found := strings.Cut(line, ":")
+		key = strings.TrimSpace(key)
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			continue
+		}
+		key = strings.ToLower(key)
+		if _, exists := secret.Meta[key]; exists {
+			continue
+		}
+		secret.Meta[key] = strings.TrimSpace(value)
+	}
+
+	return secret
+}
+
+// NeverCache reports whether the entry opted out of caching with a
+// 'cache: never' line
+func (s Secret) NeverCache() bool {
+	return strings.EqualFold(s.Meta["cache"], "never")
+}
@@ -0,0 +1,47 @@
+package state
+
+import "testing"
+
+func TestParseEntry(t *testing.T) {
+	secret := parseEntry("  s3cret \nenv: GITHUB_TOKEN\nURL: https://github.com\nnot metadata\nenv: IGNORED\n")
+
+	if secret.Value != "s3cret" {
+		t.Errorf("Expected value 's3cret', got '%s'", secret.Value)
+	}
+
+	expected := map[string]string{
+		"env": "GITHUB_TOKEN",
+		"url": "https://github.com",
+	}
+	if len(secret.Meta) != len(expected) {
+		t.Errorf("Expected metadata %v, got %v", expected, secret.Meta)
+	}
+	for key, value := range expected {
+		if secret.Meta[key] != value {
+			t.Errorf("Meta '%s': expected '%s', got '%s'", key, value, secret.Meta[key])
+		}
+	}
+}
+
+func TestParseEntrySingleLine(t *testing.T) {
+	secret := parseEntry("s3cret")
+
+	if secret.Value != "s3cret" {
+		t.Errorf("Expected value 's3cret', got '%s'", secret.Value)
+	}
+	if len(secret.Meta) != 0 {
+		t.Errorf("Expected no metadata, got %v", secret.Meta)
+	}
+}
+
+func TestSecretNeverCache(t *testing.T) {
+	if !parseEntry("s3cret\ncache: Never\n").NeverCache() {
+		t.Error("Expected 'cache: Never' to opt out of caching")
+	}
+	if parseEntry("s3cret\ncache: yes\n").NeverCache() {
+		t.Error("Expected 'cache: yes' to allow caching")
+	}
+	if parseEntry("s3cret").NeverCache() {
+		t.Error("Expected entries without metadata to allow caching")
+	}
+}
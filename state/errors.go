@@ -0,0 +1,173 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ErrorKind classifies why a secret could not be fetched
+type ErrorKind int
+
+const (
+	// ErrFailed is a failure that fits none of the other kinds
+	ErrFailed ErrorKind = iota
+	ErrNotFound
+	ErrDecryptFailed
+	ErrCancelled
+	ErrUnavailable
+	ErrTimeout
+	// ErrUnlockRequired is a key that needs a passphrase while Interactive
+	// is off
+	ErrUnlockRequired
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrNotFound:
+		return "not found"
+	case ErrDecryptFailed:
+		return "decryption failed"
+	case ErrCancelled:
+		return "cancelled"
+	case ErrUnavailable:
+		return "backend unavailable"
+	case ErrTimeout:
+		return "timed out"
+	case ErrUnlockRequired:
+		return "unlock required"
+	}
+	return "failed"
+}
+
+// The order in which kinds decide what a FetchError as a whole is. A
+// cancelled prompt explains the rest, and a missing secret matters least.
+var kindPriority = []ErrorKind{ErrCancelled, ErrTimeout, ErrUnlockRequired, ErrUnavailable, ErrDecryptFailed, ErrNotFound, ErrFailed}
+
+// SecretError is the failure to fetch the secret Ref refers to
+type SecretError struct {
+	Ref  string
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *SecretError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SecretError) Unwrap() error {
+	return e.Err
+}
+
+// Is lets errors.Is match a SecretError by its kind, as in
+// errors.Is(err, ErrNotFound)
+func (e *SecretError) Is(target error) bool {
+	kind, ok := target.(ErrorKind)
+	return ok && kind == e.Kind
+}
+
+// Error lets an ErrorKind be the target of errors.Is
+func (k ErrorKind) Error() string {
+	return k.String()
+}
+
+// secretError returns an error of the given kind, the reference is filled in
+// by ResolveSecret
+func secretError(kind ErrorKind, format string, args ...any) error {
+	return &SecretError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// asSecretError returns err as a SecretError for ref, classifying errors that
+// aren't one already as ErrFailed
+func asSecretError(ref string, err error) *SecretError {
+	var secretErr *SecretError
+	if errors.As(err, &secretErr) {
+		if secretErr.Ref == ref {
+			return secretErr
+		}
+		return &SecretError{Ref: ref, Kind: secretErr.Kind, Err: err}
+	}
+	return &SecretError{Ref: ref, Kind: ErrFailed, Err: err}
+}
+
+// unlockRequired is the error for name when decrypting it needs a passphrase
+// that can't be asked for
+func unlockRequired(name string) error {
+	return secretError(ErrUnlockRequired,
+		"unlock required for '%s': its key is locked, and pass-env doesn't prompt in non-interactive mode. "+
+			"Unlock the key first, or use --pe-cache-only", name)
+}
+
+// contextError is the error for ref when ctx ended its fetch
+func contextError(ctx context.Context, ref string) *SecretError {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &SecretError{Ref: ref, Kind: ErrTimeout, Err: fmt.Errorf("fetching '%s' timed out", ref)}
+	}
+	return &SecretError{Ref: ref, Kind: ErrCancelled, Err: fmt.Errorf("fetching '%s' was cancelled", ref)}
+}
+
+// FetchError holds every secret that could not be fetched, ordered by ref
+type FetchError struct {
+	Errors []*SecretError
+}
+
+func (e *FetchError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+
+	lines := make([]string, 0, len(e.Errors)+1)
+	lines = append(lines, fmt.Sprintf("failed to fetch %d secrets:", len(e.Errors)))
+	for _, err := range e.Errors {
+		lines = append(lines, "  "+strings.ReplaceAll(err.Error(), "\n", "\n    "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *FetchError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Kind returns the kind that best explains the failure as a whole
+func (e *FetchError) Kind() ErrorKind {
+	for _, kind := range kindPriority {
+		for _, err := range e.Errors {
+			if err.Kind == kind {
+				return kind
+			}
+		}
+	}
+	return ErrFailed
+}
+
+// gpgErrorKind classifies a failed gpg or pass(1) run by its error and output
+func gpgErrorKind(err error, output string) ErrorKind {
+	if errors.Is(err, exec.ErrNotFound) {
+		return ErrUnavailable
+	}
+
+	switch {
+	case strings.Contains(output, "is not in the password store"):
+		return ErrNotFound
+	case strings.Contains(output, "can't get input"):
+		return ErrUnlockRequired
+	case !Interactive && (strings.Contains(output, "No pinentry") ||
+		strings.Contains(output, "Inappropriate ioctl for device")):
+		return ErrUnlockRequired
+	case strings.Contains(output, "Operation cancelled"), strings.Contains(output, "Operation canceled"):
+		return ErrCancelled
+	case strings.Contains(output, "Timeout"):
+		return ErrTimeout
+	case strings.Contains(output, "No pinentry"),
+		strings.Contains(output, "Inappropriate ioctl for device"),
+		strings.Contains(output, "can't connect to the agent"):
+		return ErrUnavailable
+	}
+	return ErrDecryptFailed
+}
@@ -0,0 +1,197 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingSource returns a testSource that fails the refs in fail, and serves
+// every other ref of the given ones
+func failingSource(t *testing.T, refs []string, fail map[string]ErrorKind) *testSource {
+	source := &testSource{secrets: make(map[string]string), fail: fail, key: "failing"}
+	for _, ref := range refs {
+		source.secrets[ref] = ref
+	}
+	registerTestSource(t, "failing", source)
+	return source
+}
+
+func TestFetchSecretsCollectsErrors(t *testing.T) {
+	failingSource(t, []string{"a", "b", "c", "d"}, map[string]ErrorKind{
+		"b": ErrNotFound,
+		"c": ErrDecryptFailed,
+		"d": ErrNotFound,
+	})
+
+	_, err := FetchSecrets(context.Background(), map[string]string{
+		"A": "failing:a",
+		"B": "failing:b",
+		"C": "failing:c",
+		"D": "failing:d",
+	})
+
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) {
+		t.Fatalf("Expected a FetchError, got %v", err)
+	}
+	var refs []string
+	for _, secretErr := range fetchErr.Errors {
+		refs = append(refs, secretErr.Ref)
+	}
+	if strings.Join(refs, " ") != "failing:b failing:c failing:d" {
+		t.Errorf("Expected every failure in ref order, got %v", refs)
+	}
+	if fetchErr.Kind() != ErrDecryptFailed {
+		t.Errorf("Expected decryption failures to outrank missing secrets, got %s", fetchErr.Kind())
+	}
+	if !strings.Contains(err.Error(), "failed to fetch 3 secrets") {
+		t.Errorf("Unexpected message: %s", err)
+	}
+}
+
+func TestFetchSecretsStopsAfterCancelledFirst(t *testing.T) {
+	source := failingSource(t, []string{"a", "b", "c"}, map[string]ErrorKind{
+		"a": ErrCancelled,
+		"b": ErrCancelled,
+	})
+
+	_, err := FetchSecrets(context.Background(), map[string]string{"A": "failing:a", "B": "failing:b", "C": "failing:c"})
+
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) || fetchErr.Kind() != ErrCancelled {
+		t.Fatalf("Expected a cancelled FetchError, got %v", err)
+	}
+	if calls := source.totalCalls(); calls != 1 {
+		t.Errorf("Expected only the first secret to be fetched, got %d fetches", calls)
+	}
+}
+
+func TestFetchSecretsSkipsOnlySameKeyAfterUnavailable(t *testing.T) {
+	source := failingSource(t, []string{"a", "b", "c"}, map[string]ErrorKind{
+		"a": ErrUnavailable,
+	})
+	other := &testSource{
+		secrets: map[string]string{"x": "value", "y": "value"},
+		fail:    map[string]ErrorKind{"y": ErrNotFound},
+		key:     "other",
+	}
+	registerTestSource(t, "other", other)
+
+	_, err := FetchSecrets(context.Background(), map[string]string{
+		"A": "failing:a", "B": "failing:b", "C": "failing:c", "X": "other:x", "Y": "other:y",
+	})
+
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) {
+		t.Fatalf("Expected a FetchError, got %v", err)
+	}
+	var refs []string
+	for _, secretErr := range fetchErr.Errors {
+		refs = append(refs, secretErr.Ref)
+	}
+	if !slices.Equal(refs, []string{"failing:a", "failing:b", "failing:c", "other:y"}) {
+		t.Errorf("Expected failures for the failing source and other:y, got %v", refs)
+	}
+	if kind := fetchErr.Errors[1].Kind; kind != ErrUnavailable {
+		t.Errorf("Expected the skipped secrets to be unavailable, got %s", kind)
+	}
+	if calls := source.totalCalls(); calls != 1 {
+		t.Errorf("Expected only the first secret of the unavailable key to be fetched, got %d fetches", calls)
+	}
+	if calls := other.totalCalls(); calls != 2 {
+		t.Errorf("Expected both secrets of the other key to be fetched, got %d fetches", calls)
+	}
+}
+
+func TestUnclassifiedErrors(t *testing.T) {
+	registerTestSource(t, "fake", &testSource{})
+
+	_, err := ResolveSecret(context.Background(), "fake:missing")
+	var secretErr *SecretError
+	if !errors.As(err, &secretErr) || secretErr.Kind != ErrFailed || secretErr.Ref != "fake:missing" {
+		t.Errorf("Expected an ErrFailed SecretError for fake:missing, got %#v", err)
+	}
+}
+
+func TestGPGErrorKind(t *testing.T) {
+	cases := []struct {
+		err      error
+		output   string
+		expected ErrorKind
+	}{
+		{exec.ErrNotFound, "", ErrUnavailable},
+		{errors.New("exit status 1"), "Error: prod/db is not in the password store.", ErrNotFound},
+		{errors.New("exit status 2"), "gpg: public key decryption failed: Operation cancelled", ErrCancelled},
+		{errors.New("exit status 2"), "gpg: public key decryption failed: Timeout", ErrTimeout},
+		{errors.New("exit status 2"), "gpg: public key decryption failed: No pinentry", ErrUnavailable},
+		{errors.New("exit status 2"), "gpg: decryption failed: No secret key", ErrDecryptFailed},
+		{errors.New("exit status 2"), "gpg: Sorry, we are in batchmode - can't get input", ErrUnlockRequired},
+	}
+
+	for _, c := range cases {
+		if actual := gpgErrorKind(c.err, c.output); actual != c.expected {
+			t.Errorf("gpgErrorKind(%v, %q): expected %s, got %s", c.err, c.output, c.expected, actual)
+		}
+	}
+
+	Interactive = false
+	t.Cleanup(func() { Interactive = true })
+	if kind := gpgErrorKind(errors.New("exit status 2"), "gpg: public key decryption failed: No pinentry"); kind != ErrUnlockRequired {
+		t.Errorf("Expected a missing pinentry to need unlocking in non-interactive mode, got %s", kind)
+	}
+}
+
+func TestNonInteractiveGPG(t *testing.T) {
+	Interactive = false
+	t.Cleanup(func() { Interactive = true })
+	t.Setenv("PASSWORD_STORE_GPG_OPTS", "--trust-model always")
+
+	_, opts := passGPG()
+	if !strings.Contains(strings.Join(opts, " "), "--no-tty --pinentry-mode loopback") {
+		t.Errorf("Expected gpg to be kept from prompting, got %v", opts)
+	}
+
+	env := passEnv("/store")
+	if !slices.Contains(env, "PASSWORD_STORE_GPG_OPTS=--trust-model always --batch --no-tty --pinentry-mode loopback") {
+		t.Errorf("Expected pass to be kept from prompting, got %v", env[len(env)-2:])
+	}
+}
+
+func TestFetchSecretsTimeout(t *testing.T) {
+	oldInteractive := Interactive
+	Interactive = false
+	t.Cleanup(func() { Interactive = oldInteractive })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The shell forks sleep, which holds on to its stdout until it is
+	// stopped too
+	start := time.Now()
+	_, err := FetchSecrets(ctx, map[string]string{"SLOW": "cmd:sleep 10; echo slow", "SLOWER": "cmd:sleep 20; echo slower"})
+
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) || fetchErr.Kind() != ErrTimeout {
+		t.Fatalf("Expected a timed out FetchError, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= cancelGrace {
+		t.Errorf("Expected the command and its children to be stopped at the deadline, took %s", elapsed)
+	}
+}
+
+func TestFetchSecretsCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	_, err := FetchSecrets(ctx, map[string]string{"SLOW": "cmd:sleep 10"})
+
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) || fetchErr.Kind() != ErrCancelled {
+		t.Fatalf("Expected a cancelled FetchError, got %v", err)
+	}
+}
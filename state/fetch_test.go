@@ -0,0 +1,143 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchSecretsConcurrency(t *testing.T) {
+	source := &testSource{secrets: make(map[string]string), key: "counting", delay: 10 * time.Millisecond}
+	for i := range 10 {
+		source.secrets[fmt.Sprintf("s%d", i)] = fmt.Sprintf("value-s%d", i)
+	}
+	registerTestSource(t, "counting", source)
+	oldConcurrency := FetchConcurrency
+	FetchConcurrency = 3
+	t.Cleanup(func() { FetchConcurrency = oldConcurrency })
+
+	envPairs := make(map[string]string)
+	for i := range 20 {
+		envPairs[fmt.Sprintf("VAR_%d", i)] = fmt.Sprintf("counting:s%d", i%10)
+	}
+
+	secrets, err := FetchSecrets(context.Background(), envPairs)
+	if err != nil {
+		t.Fatalf("FetchSecrets failed: %v", err)
+	}
+
+	for name, ref := range envPairs {
+		if secrets[name].Value != "value-"+ref[len("counting:"):] {
+			t.Errorf("Expected %s to be set from %s, got %q", name, ref, secrets[name].Value)
+		}
+	}
+	for ref, calls := range source.calls {
+		if calls != 1 {
+			t.Errorf("Expected %s to be resolved once, got %d", ref, calls)
+		}
+	}
+	if len(source.calls) != 10 {
+		t.Errorf("Expected 10 unique refs resolved, got %d", len(source.calls))
+	}
+	if source.peak > 3 {
+		t.Errorf("Expected at most 3 resolves at once, got %d", source.peak)
+	}
+	if source.overlap {
+		t.Error("Expected the first resolve to run on its own")
+	}
+}
+
+func TestFetchSecretsSharesConcurrencyLimit(t *testing.T) {
+	source := &testSource{secrets: make(map[string]string), delay: 10 * time.Millisecond}
+	registerTestSource(t, "shared", source)
+	oldConcurrency := FetchConcurrency
+	FetchConcurrency = 3
+	t.Cleanup(func() { FetchConcurrency = oldConcurrency })
+
+	fetches := make([]map[string]string, 4)
+	for fetch := range fetches {
+		fetches[fetch] = make(map[string]string)
+		for i := range 5 {
+			ref := fmt.Sprintf("f%d-s%d", fetch, i)
+			source.secrets[ref] = "value"
+			fetches[fetch][fmt.Sprintf("VAR_%d", i)] = "shared:" + ref
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, envPairs := range fetches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := FetchSecrets(context.Background(), envPairs); err != nil {
+				t.Errorf("FetchSecrets failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if source.peak > 3 {
+		t.Errorf("Expected at most 3 resolves at once across all fetches, got %d", source.peak)
+	}
+}
+
+func TestFetchSecretsUnlocksFirstKeyedSecret(t *testing.T) {
+	keyed := &testSource{secrets: make(map[string]string), key: "gpg", delay: 10 * time.Millisecond}
+	for i := range 5 {
+		keyed.secrets[fmt.Sprintf("s%d", i)] = "value"
+	}
+	// Sorts before the keyed refs, like cmd: and file: refs do before pass
+	// names
+	plain := &testSource{secrets: map[string]string{"x": "value"}}
+	registerTestSource(t, "keyed", keyed)
+	registerTestSource(t, "aplain", plain)
+
+	envPairs := map[string]string{"PLAIN": "aplain:x"}
+	for i := range 5 {
+		envPairs[fmt.Sprintf("VAR_%d", i)] = fmt.Sprintf("keyed:s%d", i)
+	}
+
+	_, err := FetchSecrets(context.Background(), envPairs)
+	if err != nil {
+		t.Fatalf("FetchSecrets failed: %v", err)
+	}
+	if keyed.overlap {
+		t.Error("Expected the first secret with an unlock key to be resolved on its own")
+	}
+	if calls := plain.totalCalls(); calls != 1 {
+		t.Errorf("Expected the secret without a key to be resolved once, got %d", calls)
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	keyed := &testSource{secrets: map[string]string{"a": "value", "b": "value"}, key: "gpg"}
+	other := &testSource{secrets: map[string]string{"c": "value"}, key: "age"}
+	plain := &testSource{secrets: map[string]string{"x": "value"}}
+	registerTestSource(t, "keyed", keyed)
+	registerTestSource(t, "other", other)
+	registerTestSource(t, "plain", plain)
+
+	err := Unlock(context.Background(), []string{"keyed:b", "plain:x", "keyed:a", "other:c"})
+	if err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if keyed.calls["a"] != 1 || keyed.calls["b"] != 0 {
+		t.Errorf("Expected only the first secret of the key to be fetched, got %v", keyed.calls)
+	}
+	if calls := keyed.totalCalls() + other.totalCalls(); calls != 2 {
+		t.Errorf("Expected one fetch per key, got %d", calls)
+	}
+	if calls := plain.totalCalls(); calls != 0 {
+		t.Errorf("Expected secrets without a key not to be fetched, got %d fetches", calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Unlock(ctx, []string{"keyed:a"})
+	if !errors.Is(err, ErrCancelled) {
+		t.Errorf("Expected a cancelled error, got %v", err)
+	}
+}
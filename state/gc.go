@@ -0,0 +1,173 @@
+package state
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/otard95/pass-env/lib/set"
+)
+
+// Cache entries younger than this are never treated as orphans, since a
+// concurrent pass-env run writes the entry before it updates the index
+const orphanGracePeriod = time.Minute
+
+// IndexLink is a single pass name -> cache entry link in the index
+type IndexLink struct {
+	PassName string
+	Hash     string
+}
+
+// GCReport describes what GC changed, or would change in a dry run
+type GCReport struct {
+	// Cache entries no index link refers to
+	OrphanedEntries []string
+	// Index links to cache entries that don't exist
+	DanglingLinks []IndexLink
+	// Index links the metadata of the linked cache entry doesn't agree with
+	StaleLinks []IndexLink
+	// Index links restored from the metadata of cache entries
+	RestoredLinks []IndexLink
+	// Cache entries whose metadata could not be read while rebuilding
+	Unreadable []string
+}
+
+func (r *GCReport) Empty() bool {
+	return len(r.OrphanedEntries) == 0 &&
+		len(r.DanglingLinks) == 0 &&
+		len(r.StaleLinks) == 0 &&
+		len(r.RestoredLinks) == 0
+}
+
+// GC reconciles the index with the cache entries in the store. It removes
+// index links to missing entries and entries no link refers to. With
+// rebuildIndex, the links of every entry are made to match its metadata,
+// which means decrypting every entry. Legacy entries have no metadata and
+// keep their links. With dryRun nothing is changed. GC fails if the index
+// can't be read, since every entry would look orphaned.
+func GC(ctx context.Context, rebuildIndex, dryRun bool) (*GCReport, error) {
+	report := &GCReport{}
+
+	hashes, err := ListCache()
+	if err != nil {
+		return nil, err
+	}
+	stored := make(set.Set[string])
+	for _, hash := range hashes {
+		stored.Add(hash)
+	}
+
+	fromMetadata := make(passNameDependents)
+	described := make(set.Set[string])
+	if rebuildIndex {
+		for _, hash := range hashes {
+			entry, err := ReadCacheEntry(ctx, hash)
+			if err != nil {
+				report.Unreadable = append(report.Unreadable, hash)
+				continue
+			}
+			if entry.IsLegacy() {
+				continue
+			}
+			described.Add(hash)
+			for _, passName := range entry.PassNames {
+				if _, exists := fromMetadata[passName]; !exists {
+					fromMetadata[passName] = make(set.Set[string])
+				}
+				deps := fromMetadata[passName]
+				deps.Add(hash)
+			}
+		}
+	}
+
+	referenced := make(set.Set[string])
+	reconcile := func(deps passNameDependents) {
+		for passName, hashes := range fromMetadata {
+			if _, exists := deps[passName]; !exists {
+				deps[passName] = make(set.Set[string])
+			}
+			linked := deps[passName]
+			for hash := range hashes {
+				if linked.Add(hash) {
+					report.RestoredLinks = append(report.RestoredLinks, IndexLink{passName, hash})
+				}
+			}
+		}
+
+		for passName, linked := range deps {
+			for hash := range linked {
+				if !stored.Contains(hash) {
+					report.DanglingLinks = append(report.DanglingLinks, IndexLink{passName, hash})
+					linked.Remove(hash)
+					continue
+				}
+				if described.Contains(hash) {
+					fromEntry := fromMetadata[passName]
+					if !fromEntry.Contains(hash) {
+						report.StaleLinks = append(report.StaleLinks, IndexLink{passName, hash})
+						linked.Remove(hash)
+						continue
+					}
+				}
+				referenced.Add(hash)
+			}
+			if len(linked) == 0 {
+				delete(deps, passName)
+			}
+		}
+	}
+
+	if dryRun {
+		current, err := readIndex(ctx)
+		if err != nil {
+			return nil, err
+		}
+		reconcile(current)
+	} else {
+		err = modifyReadableIndex(ctx, reconcile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, hash := range hashes {
+		if !referenced.Contains(hash) && !isRecentEntry(hash) {
+			report.OrphanedEntries = append(report.OrphanedEntries, hash)
+		}
+	}
+
+	sortLinks(report.DanglingLinks)
+	sortLinks(report.StaleLinks)
+	sortLinks(report.RestoredLinks)
+
+	if dryRun {
+		return report, nil
+	}
+
+	err = Clear(ctx, report.OrphanedEntries...)
+	if err != nil {
+		return report, err
+	}
+
+	err = modifyUsage(func(usage cacheUsage) {
+		for hash := range usage {
+			if !stored.Contains(hash) || slices.Contains(report.OrphanedEntries, hash) {
+				delete(usage, hash)
+			}
+		}
+	})
+	return report, err
+}
+
+func isRecentEntry(hash string) bool {
+	meta, err := cacheBackend.Metadata(hash)
+	return err == nil && time.Since(meta.Modified) < orphanGracePeriod
+}
+
+func sortLinks(links []IndexLink) {
+	slices.SortFunc(links, func(a, b IndexLink) int {
+		return cmp.Or(strings.Compare(a.PassName, b.PassName), strings.Compare(a.Hash, b.Hash))
+	})
+}
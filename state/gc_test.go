@@ -0,0 +1,82 @@
+package state
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGCRemovesDanglingLinks(t *testing.T) {
+	setupIndexTestEnv(t)
+
+	err := UpdateIndex(context.Background(), "missing-hash", []string{"prod/db"})
+	if err != nil {
+		t.Fatalf("UpdateIndex failed: %v", err)
+	}
+
+	report, err := GC(context.Background(), false, true)
+	if err != nil {
+		t.Fatalf("GC dry run failed: %v", err)
+	}
+	if len(report.DanglingLinks) != 1 || report.DanglingLinks[0] != (IndexLink{"prod/db", "missing-hash"}) {
+		t.Errorf("Expected one dangling link, got %v", report.DanglingLinks)
+	}
+
+	index = nil
+	if len(GetDependents(context.Background(), "prod/db")) != 1 {
+		t.Error("Expected the dry run to leave the index untouched")
+	}
+
+	_, err = GC(context.Background(), false, false)
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+
+	index = nil
+	if deps := GetDependents(context.Background(), "prod/db"); len(deps) != 0 {
+		t.Errorf("Expected the dangling link to be removed, got %v", deps)
+	}
+
+	report, err = GC(context.Background(), false, false)
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if !report.Empty() {
+		t.Errorf("Expected nothing left to do, got %+v", report)
+	}
+}
+
+func TestGCKeepsEntriesWhenIndexUnreadable(t *testing.T) {
+	setupIndexTestEnv(t)
+	oldBackend := cacheBackend
+	t.Cleanup(func() { cacheBackend = oldBackend })
+	backend := NewMemoryBackend().(*memoryBackend)
+	SetCacheBackend(backend)
+
+	if err := backend.Set(context.Background(), "old-hash", []byte("entry"), 0); err != nil {
+		t.Fatal(err)
+	}
+	backend.written["old-hash"] = time.Now().Add(-time.Hour)
+
+	corrupt, err := encryptIndex(context.Background(), []byte("not a gob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes := map[string][]byte{
+		"undecryptable": []byte("-----BEGIN PGP MESSAGE-----\nnot really\n-----END PGP MESSAGE-----\n"),
+		"corrupt":       corrupt,
+	}
+	for name, data := range indexes {
+		if err := os.WriteFile(StoreIndex(), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := GC(context.Background(), false, false); err == nil {
+			t.Errorf("%s: expected GC to fail", name)
+		}
+		if _, err := backend.Get(context.Background(), "old-hash"); err != nil {
+			t.Errorf("%s: expected the entry to be kept, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/otard95/pass-env/lib/fs"
+)
+
+// The options pass(1) itself uses for every gpg call
+var gpgOpts = []string{"--quiet", "--yes", "--compress-algo=none", "--no-encrypt-to"}
+
+// DirectGPG enables decrypting .gpg files with gpg directly, rather than
+// through a pass(1) process per secret
+var DirectGPG = true
+
+// Interactive lets gpg, pass and passage ask for passphrases. Without it a
+// locked key fails with an ErrUnlockRequired instead of prompting.
+var Interactive = true
+
+// The options that keep gpg from prompting, for a passphrase or anything else
+var nonInteractiveGPGOpts = []string{"--batch", "--no-tty", "--pinentry-mode", "loopback"}
+
+// passGPG returns the gpg binary and options pass(1) would use:
+// $PASSWORD_STORE_GPG_OPTS followed by its own, gpg2 if it is installed, and
+// the agent in batch mode with gpg2 or an agent from $GPG_AGENT_INFO
+func passGPG() (string, []string) {
+	opts := append(strings.Fields(os.Getenv("PASSWORD_STORE_GPG_OPTS")), gpgOpts...)
+
+	gpg := "gpg"
+	if _, err := exec.LookPath("gpg2"); err == nil {
+		gpg = "gpg2"
+	}
+	if os.Getenv("GPG_AGENT_INFO") != "" || gpg == "gpg2" {
+		opts = append(opts, "--batch", "--use-agent")
+	}
+	if !Interactive {
+		opts = append(opts, nonInteractiveGPGOpts...)
+	}
+
+	return gpg, opts
+}
+
+// canDecryptDirectly reports whether file can be decrypted with gpg directly
+// and give what pass(1) would. Extensions, and files pass finds somewhere
+// else than where they are expected, e.g. in a tomb, are left to pass.
+func canDecryptDirectly(file string) bool {
+	if !DirectGPG || os.Getenv("PASSWORD_STORE_ENABLE_EXTENSIONS") == "true" || !fs.IsFile(file) {
+		return false
+	}
+	gpg, _ := passGPG()
+	_, err := exec.LookPath(gpg)
+	return err == nil
+}
+
+// decryptFile decrypts a .gpg file the way 'pass show' does
+func decryptFile(ctx context.Context, file string) ([]byte, error) {
+	gpg, opts := passGPG()
+	args := append(append([]string{"-d"}, opts...), file)
+
+	var stdout, stderr bytes.Buffer
+	gpgCmd := commandContext(ctx, gpg, args...)
+	gpgCmd.Env = os.Environ()
+	if os.Getenv("GPG_TTY") == "" && Interactive {
+		if tty, err := os.Readlink("/proc/self/fd/0"); err == nil && strings.HasPrefix(tty, "/dev/") {
+			gpgCmd.Env = append(gpgCmd.Env, "GPG_TTY="+tty)
+		}
+	}
+	gpgCmd.Stdout = &stdout
+	gpgCmd.Stderr = &stderr
+
+	err := gpgCmd.Run()
+	if err != nil {
+		return nil, secretError(gpgErrorKind(err, stderr.String()), "gpg failed: %s\n%s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// passEnv returns the environment to run pass(1) on store in, which keeps
+// the gpg pass runs from prompting if Interactive is off
+func passEnv(store string) []string {
+	env := append(os.Environ(), "PASSWORD_STORE_DIR="+store)
+	if !Interactive {
+		opts := append(strings.Fields(os.Getenv("PASSWORD_STORE_GPG_OPTS")), nonInteractiveGPGOpts...)
+		env = append(env, "PASSWORD_STORE_GPG_OPTS="+strings.Join(opts, " "))
+	}
+	return env
+}
+
+// storeRecipients returns the gpg ids pass-env's own store is encrypted to:
+// $PASSWORD_STORE_KEY if set, as pass(1) does, or the store's .gpg-id
+func storeRecipients() ([]string, error) {
+	if keys := strings.Fields(os.Getenv("PASSWORD_STORE_KEY")); len(keys) > 0 {
+		return keys, nil
+	}
+
+	content, err := os.ReadFile(path.Join(Store(), ".gpg-id"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the store's gpg ids: %s", err)
+	}
+
+	var recipients []string
+	for line := range strings.Lines(string(content)) {
+		id, _, _ := strings.Cut(line, "#")
+		id = strings.TrimSpace(id)
+		if id != "" {
+			recipients = append(recipients, id)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("the store's .gpg-id is empty")
+	}
+
+	return recipients, nil
+}
+
+// gpgEncrypt encrypts data to the same recipients as pass-env's own store
+func gpgEncrypt(ctx context.Context, data []byte) ([]byte, error) {
+	recipients, err := storeRecipients()
+	if err != nil {
+		return nil, err
+	}
+
+	args := append([]string{"--batch", "--encrypt"}, gpgOpts...)
+	for _, recipient := range recipients {
+		args = append(args, "--recipient", recipient)
+	}
+
+	return runGPG(ctx, data, args...)
+}
+
+func gpgDecrypt(ctx context.Context, data []byte) ([]byte, error) {
+	args := append([]string{"--decrypt"}, gpgOpts...)
+	return runGPG(ctx, data, args...)
+}
+
+func runGPG(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	if !Interactive {
+		args = append(slices.Clip(args), nonInteractiveGPGOpts...)
+	}
+
+	gpgCmd := commandContext(ctx, "gpg", args...)
+	gpgCmd.Stdin = bytes.NewReader(stdin)
+	gpgCmd.Stdout = &stdout
+	gpgCmd.Stderr = &stderr
+
+	err := gpgCmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("gpg failed: %s\n%s", err, stderr.String())
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,119 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// setupPassStore links a pass store of n entries, secret/N holding valueN,
+// encrypted to a throwaway key. A fake pass(1) answering 'from-pass' shows
+// when decryption went through pass instead.
+func setupPassStore(t testing.TB, n int) {
+	userID := setupGPG(t)
+
+	oldPath, oldDirect := Path, DirectGPG
+	t.Cleanup(func() { Path, DirectGPG = oldPath, oldDirect })
+	Path = t.TempDir()
+	DirectGPG = true
+
+	passStore := filepath.Join(t.TempDir(), "password-store")
+	if err := os.MkdirAll(filepath.Join(passStore, "secret"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(passStore, ".gpg-id"), []byte(userID+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		file := filepath.Join(passStore, "secret", fmt.Sprintf("%d.gpg", i))
+		gpgCmd := exec.Command("gpg", "--batch", "--quiet", "--encrypt", "--recipient", userID, "--output", file)
+		gpgCmd.Stdin = strings.NewReader(fmt.Sprintf("value%d\n", i))
+		if out, err := gpgCmd.CombinedOutput(); err != nil {
+			t.Fatalf("Failed to encrypt entry: %v\n%s", err, out)
+		}
+	}
+	if err := os.Symlink(passStore, PassStore()); err != nil {
+		t.Fatal(err)
+	}
+
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "pass"), []byte("#!/bin/sh\necho from-pass\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestDirectDecrypt(t *testing.T) {
+	setupPassStore(t, 1)
+
+	fetch := func() (string, error) {
+		secrets, err := GetSecrets(context.Background(), map[string]string{"SECRET": "secret/0"})
+		return secrets["SECRET"], err
+	}
+
+	if value, err := fetch(); err != nil || value != "value0" {
+		t.Errorf("Expected value0 decrypted directly, got %q %v", value, err)
+	}
+
+	t.Setenv("PASSWORD_STORE_GPG_OPTS", "--no-such-option")
+	if _, err := fetch(); err == nil {
+		t.Error("Expected PASSWORD_STORE_GPG_OPTS to be passed to gpg")
+	}
+	t.Setenv("PASSWORD_STORE_GPG_OPTS", "")
+
+	t.Setenv("PASSWORD_STORE_ENABLE_EXTENSIONS", "true")
+	if value, _ := fetch(); value != "from-pass" {
+		t.Errorf("Expected pass to be used with extensions enabled, got %q", value)
+	}
+	t.Setenv("PASSWORD_STORE_ENABLE_EXTENSIONS", "")
+
+	DirectGPG = false
+	if value, _ := fetch(); value != "from-pass" {
+		t.Errorf("Expected pass to be used with DirectGPG disabled, got %q", value)
+	}
+}
+
+func TestStoreRecipients(t *testing.T) {
+	oldPath := Path
+	Path = t.TempDir()
+	t.Cleanup(func() { Path = oldPath })
+
+	if err := os.MkdirAll(Store(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := "# the team\nalice@example.com\n\nbob@example.com # laptop\n"
+	if err := os.WriteFile(filepath.Join(Store(), ".gpg-id"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	recipients, err := storeRecipients()
+	if err != nil || !slices.Equal(recipients, []string{"alice@example.com", "bob@example.com"}) {
+		t.Errorf("Unexpected recipients from .gpg-id: %v %v", recipients, err)
+	}
+
+	t.Setenv("PASSWORD_STORE_KEY", "0xAAAA 0xBBBB")
+	recipients, err = storeRecipients()
+	if err != nil || !slices.Equal(recipients, []string{"0xAAAA", "0xBBBB"}) {
+		t.Errorf("Expected PASSWORD_STORE_KEY to win, got %v %v", recipients, err)
+	}
+}
+
+func BenchmarkFetchSecrets(b *testing.B) {
+	setupPassStore(b, 10)
+
+	requests := make(map[string]string)
+	for i := range 10 {
+		requests[fmt.Sprintf("SECRET_%d", i)] = fmt.Sprintf("secret/%d", i)
+	}
+
+	for b.Loop() {
+		if _, err := FetchSecrets(context.Background(), requests); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
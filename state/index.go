@@ -0,0 +1,280 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/otard95/pass-env/lib/fs"
+	"github.com/otard95/pass-env/lib/set"
+)
+
+// The cache entries in pass-env's own store that are dependent on pass names
+type passNameDependents map[string]set.Set[string]
+
+var (
+	// indexMu guards index, which concurrent fetches update
+	indexMu sync.Mutex
+	// The index, loaded on first use since decrypting it costs a gpg call
+	index passNameDependents
+)
+
+// StoreIndex is the index, encrypted to the same gpg ids as the store since
+// it lists every pass name pass-env has cached. If pass-env was initialized
+// without a gpg key it is encrypted with age instead.
+func StoreIndex() string {
+	if !storeUsesGPG() {
+		return path.Join(Path, "store.index.age")
+	}
+	return path.Join(Path, "store.index.gpg")
+}
+
+// storeUsesGPG reports whether pass-env's own store has a gpg key
+func storeUsesGPG() bool {
+	return fs.IsFile(path.Join(Store(), ".gpg-id"))
+}
+
+// encryptIndex encrypts the index with gpg, or with the AgeIdentity if the
+// store has no gpg key
+func encryptIndex(ctx context.Context, data []byte) ([]byte, error) {
+	if storeUsesGPG() {
+		return gpgEncrypt(ctx, data)
+	}
+	backend, err := newAgeBackend(AgeIdentity)
+	if err != nil {
+		return nil, err
+	}
+	return backend.encrypt(data)
+}
+
+func decryptIndex(ctx context.Context, data []byte) ([]byte, error) {
+	if storeUsesGPG() {
+		return gpgDecrypt(ctx, data)
+	}
+	backend, err := newAgeBackend(AgeIdentity)
+	if err != nil {
+		return nil, err
+	}
+	return backend.decrypt(data)
+}
+
+// The unencrypted index written by earlier versions of pass-env
+func legacyStoreIndex() string {
+	return path.Join(Path, "store.index")
+}
+
+// errCorruptIndex is an index that was read and decrypted, but can't be
+// decoded
+var errCorruptIndex = errors.New("Failed to decode index")
+
+// The lock file guarding read-modify-write cycles of the index
+func storeLock() string {
+	return path.Join(Path, "store.lock")
+}
+
+func WriteIndex(ctx context.Context) error {
+	indexMu.Lock()
+	current := index
+	indexMu.Unlock()
+
+	return writeIndex(ctx, current)
+}
+
+func writeIndex(ctx context.Context, deps passNameDependents) error {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+
+	err := encoder.Encode(deps)
+	if err != nil {
+		return fmt.Errorf("Failed encode index: %s", err)
+	}
+
+	encrypted, err := encryptIndex(ctx, buffer.Bytes())
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt index: %s", err)
+	}
+
+	err = fs.WriteFileAtomic(StoreIndex(), encrypted, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write index '%s': %s", StoreIndex(), err)
+	}
+
+	return nil
+}
+
+func readIndex(ctx context.Context) (passNameDependents, error) {
+	deps := make(passNameDependents)
+
+	file, encrypted := StoreIndex(), true
+	if !fs.IsFile(file) && fs.IsFile(legacyStoreIndex()) {
+		file, encrypted = legacyStoreIndex(), false
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return deps, nil
+		}
+		return nil, fmt.Errorf("Failed to read index '%s': %s", file, err)
+	}
+	if encrypted && len(data) > 0 {
+		data, err = decryptIndex(ctx, data)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt index '%s': %s", file, err)
+		}
+	}
+	if len(data) == 0 {
+		return deps, nil
+	}
+
+	decoder := gob.NewDecoder(bytes.NewBuffer(data))
+	err = decoder.Decode(&deps)
+	if err != nil {
+		return nil, fmt.Errorf("%w '%s': %s", errCorruptIndex, file, err)
+	}
+	if deps == nil {
+		deps = make(passNameDependents)
+	}
+
+	return deps, nil
+}
+
+// loadIndex reads the index the first time it is needed, migrating an
+// unencrypted index from earlier versions along the way
+func loadIndex(ctx context.Context) passNameDependents {
+	indexMu.Lock()
+	loaded := index
+	indexMu.Unlock()
+	if loaded != nil {
+		return loaded
+	}
+
+	if fs.IsFile(legacyStoreIndex()) {
+		err := migrateIndex(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to encrypt the index: %s\n", err)
+		}
+	}
+
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if index == nil {
+		var err error
+		index, err = readIndex(ctx)
+		if err != nil {
+			fmt.Printf(
+				"The index file is corrupt, this is not a big issue, you just wont be able to clear cache based on pass-name's\n%s\n",
+				err,
+			)
+			index = make(passNameDependents)
+		}
+	}
+
+	return index
+}
+
+// migrateIndex replaces the unencrypted index with an encrypted one
+func migrateIndex(ctx context.Context) error {
+	return modifyIndex(ctx, func(passNameDependents) {})
+}
+
+// modifyIndex applies modify to the index as it is on disk, not as it was
+// when this process loaded it, and writes the result back while holding the
+// store lock. This keeps concurrent pass-env runs from losing each other's
+// changes. An unencrypted index from earlier versions is removed once the
+// encrypted one is written.
+func modifyIndex(ctx context.Context, modify func(passNameDependents)) error {
+	return rewriteIndex(ctx, modify, true)
+}
+
+// modifyReadableIndex is modifyIndex, except that a corrupt index is an
+// error rather than replaced by an empty one, for changes that go by what
+// the index holds
+func modifyReadableIndex(ctx context.Context, modify func(passNameDependents)) error {
+	return rewriteIndex(ctx, modify, false)
+}
+
+func rewriteIndex(ctx context.Context, modify func(passNameDependents), startOver bool) error {
+	unlock, err := fs.Lock(storeLock())
+	if err != nil {
+		return fmt.Errorf("Failed to lock '%s': %s", storeLock(), err)
+	}
+	defer unlock()
+
+	current, err := readIndex(ctx)
+	if startOver && errors.Is(err, errCorruptIndex) {
+		// A corrupt index only costs us the ability to clear by pass name,
+		// so start over rather than failing every write from now on
+		fmt.Fprintf(os.Stderr, "Warning: %s, starting a new index\n", err)
+		current = make(passNameDependents)
+	} else if err != nil {
+		// Failing to decrypt it, e.g. with a locked key, says nothing about
+		// its content, which must not be lost
+		return err
+	}
+
+	modify(current)
+	indexMu.Lock()
+	index = current
+	indexMu.Unlock()
+
+	err = writeIndex(ctx, current)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(legacyStoreIndex())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove unencrypted index '%s': %s", legacyStoreIndex(), err)
+	}
+
+	return nil
+}
+
+func Index(ctx context.Context) passNameDependents {
+	return loadIndex(ctx)
+}
+
+func GetDependents(ctx context.Context, names ...string) []string {
+	result := make(set.Set[string])
+
+	for _, name := range names {
+		if deps, exists := loadIndex(ctx)[name]; exists {
+			result.Merge(deps)
+		}
+	}
+
+	return result.Items()
+}
+
+func RemoveFromIndex(ctx context.Context, names ...string) error {
+	return modifyIndex(ctx, func(deps passNameDependents) {
+		for _, name := range names {
+			delete(deps, name)
+		}
+	})
+}
+
+// UpdateIndex adds pass names to the index, mapping them to a cache hash. It
+// does nothing if the cache doesn't persist.
+func UpdateIndex(ctx context.Context, hash string, passNames []string) error {
+	if !CachePersists() {
+		return nil
+	}
+
+	return modifyIndex(ctx, func(deps passNameDependents) {
+		for _, passName := range passNames {
+			if _, exists := deps[passName]; !exists {
+				deps[passName] = make(set.Set[string])
+			}
+			s := deps[passName]
+			s.Add(hash)
+			deps[passName] = s
+		}
+	})
+}
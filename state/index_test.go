@@ -0,0 +1,291 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/otard95/pass-env/lib/set"
+)
+
+// setupGPG points gpg at a throwaway keyring holding a single key, and
+// returns the key's user id
+func setupGPG(t testing.TB) string {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not available")
+	}
+
+	home, err := os.MkdirTemp("", "pe-gpg-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GNUPGHOME", home)
+	t.Cleanup(func() {
+		exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+		os.RemoveAll(home)
+	})
+
+	userID := "pass-env-test@localhost"
+	cmd := exec.Command(
+		"gpg", "--batch", "--passphrase", "", "--quick-gen-key", userID, "default", "default", "never",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("Failed to generate a gpg key: %v\n%s", err, out)
+	}
+
+	return userID
+}
+
+func setupIndexTestEnv(t *testing.T) {
+	userID := setupGPG(t)
+
+	oldPath, oldIndex := Path, index
+	Path = t.TempDir()
+	index = nil
+	t.Cleanup(func() {
+		Path, index = oldPath, oldIndex
+	})
+
+	if err := os.MkdirAll(Store(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(Store(), ".gpg-id"), []byte(userID+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateIndexMergesWithDisk(t *testing.T) {
+	setupIndexTestEnv(t)
+
+	err := UpdateIndex(context.Background(), "hash-a", []string{"prod/db"})
+	if err != nil {
+		t.Fatalf("UpdateIndex failed: %v", err)
+	}
+
+	// Simulate another pass-env run that loaded the index before hash-a
+	// was added
+	index = nil
+	err = UpdateIndex(context.Background(), "hash-b", []string{"prod/db", "github/token"})
+	if err != nil {
+		t.Fatalf("UpdateIndex failed: %v", err)
+	}
+
+	onDisk, err := readIndex(context.Background())
+	if err != nil {
+		t.Fatalf("readIndex failed: %v", err)
+	}
+
+	deps := onDisk["prod/db"]
+	if !deps.Contains("hash-a") || !deps.Contains("hash-b") {
+		t.Errorf("Expected prod/db to depend on hash-a and hash-b, got %v", deps.Items())
+	}
+	deps = onDisk["github/token"]
+	if !deps.Contains("hash-b") {
+		t.Errorf("Expected github/token to depend on hash-b, got %v", deps.Items())
+	}
+}
+
+func TestUpdateIndexConcurrent(t *testing.T) {
+	setupIndexTestEnv(t)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := UpdateIndex(context.Background(), fmt.Sprintf("hash-%d", i), []string{"prod/db"})
+			if err != nil {
+				t.Errorf("UpdateIndex failed: %v", err)
+			}
+			GetDependents(context.Background(), "prod/db")
+		}()
+	}
+	wg.Wait()
+
+	onDisk, err := readIndex(context.Background())
+	if err != nil {
+		t.Fatalf("readIndex failed: %v", err)
+	}
+	if len(onDisk["prod/db"]) != 8 {
+		t.Errorf("Expected 8 dependents, got %d", len(onDisk["prod/db"]))
+	}
+}
+
+func TestRemoveFromIndexKeepsOtherEntries(t *testing.T) {
+	setupIndexTestEnv(t)
+
+	err := UpdateIndex(context.Background(), "hash-a", []string{"prod/db", "github/token"})
+	if err != nil {
+		t.Fatalf("UpdateIndex failed: %v", err)
+	}
+
+	index = nil
+	err = RemoveFromIndex(context.Background(), "prod/db")
+	if err != nil {
+		t.Fatalf("RemoveFromIndex failed: %v", err)
+	}
+
+	onDisk, err := readIndex(context.Background())
+	if err != nil {
+		t.Fatalf("readIndex failed: %v", err)
+	}
+	names := make([]string, 0, len(onDisk))
+	for name := range onDisk {
+		names = append(names, name)
+	}
+	if !slices.Equal(names, []string{"github/token"}) {
+		t.Errorf("Expected only github/token to remain, got %v", names)
+	}
+}
+
+func TestIndexIsEncrypted(t *testing.T) {
+	setupIndexTestEnv(t)
+
+	err := UpdateIndex(context.Background(), "hash-a", []string{"prod/db"})
+	if err != nil {
+		t.Fatalf("UpdateIndex failed: %v", err)
+	}
+
+	data, err := os.ReadFile(StoreIndex())
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	if bytes.Contains(data, []byte("prod/db")) {
+		t.Error("Expected the index not to contain pass names in plaintext")
+	}
+}
+
+func TestMigrateLegacyIndex(t *testing.T) {
+	setupIndexTestEnv(t)
+
+	legacy := passNameDependents{"prod/db": set.Set[string]{"hash-a": {}}}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacyStoreIndex(), buffer.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dependents := GetDependents(context.Background(), "prod/db")
+	if !slices.Equal(dependents, []string{"hash-a"}) {
+		t.Errorf("Expected [hash-a], got %v", dependents)
+	}
+
+	if _, err := os.Stat(legacyStoreIndex()); !os.IsNotExist(err) {
+		t.Error("Expected the unencrypted index to be removed")
+	}
+
+	index = nil
+	onDisk, err := readIndex(context.Background())
+	if err != nil {
+		t.Fatalf("readIndex failed: %v", err)
+	}
+	deps := onDisk["prod/db"]
+	if !deps.Contains("hash-a") {
+		t.Errorf("Expected the encrypted index to hold the migrated entries, got %v", onDisk)
+	}
+}
+
+func TestUpdateIndexRemovesLegacyIndex(t *testing.T) {
+	setupIndexTestEnv(t)
+
+	legacy := passNameDependents{"prod/db": set.Set[string]{"hash-a": {}}}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacyStoreIndex(), buffer.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := UpdateIndex(context.Background(), "hash-b", []string{"prod/token"})
+	if err != nil {
+		t.Fatalf("UpdateIndex failed: %v", err)
+	}
+
+	if _, err := os.Stat(legacyStoreIndex()); !os.IsNotExist(err) {
+		t.Error("Expected the unencrypted index to be removed")
+	}
+	onDisk, err := readIndex(context.Background())
+	if err != nil {
+		t.Fatalf("readIndex failed: %v", err)
+	}
+	db, token := onDisk["prod/db"], onDisk["prod/token"]
+	if !db.Contains("hash-a") || !token.Contains("hash-b") {
+		t.Errorf("Expected the legacy entries and the new one, got %v", onDisk)
+	}
+}
+
+func TestIndexGivesUpWhenCancelled(t *testing.T) {
+	setupIndexTestEnv(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := UpdateIndex(ctx, "hash-a", []string{"prod/db"}); err == nil {
+		t.Error("Expected updating the index to fail once cancelled")
+	}
+	if _, err := readIndex(ctx); err != nil {
+		t.Errorf("Expected a missing index to read as empty, got %v", err)
+	}
+
+	if err := UpdateIndex(context.Background(), "hash-a", []string{"prod/db"}); err != nil {
+		t.Fatalf("UpdateIndex failed: %v", err)
+	}
+	if _, err := readIndex(ctx); err == nil {
+		t.Error("Expected decrypting the index to fail once cancelled")
+	}
+}
+
+func TestUpdateIndexKeepsUndecryptableIndex(t *testing.T) {
+	setupIndexTestEnv(t)
+
+	undecryptable := []byte("-----BEGIN PGP MESSAGE-----\nnot really\n-----END PGP MESSAGE-----\n")
+	if err := os.WriteFile(StoreIndex(), undecryptable, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateIndex(context.Background(), "hash-b", []string{"prod/other"}); err == nil {
+		t.Error("Expected UpdateIndex to fail when the index can't be decrypted")
+	}
+
+	data, err := os.ReadFile(StoreIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, undecryptable) {
+		t.Error("Expected the index that couldn't be decrypted to be left alone")
+	}
+}
+
+func TestUpdateIndexReplacesCorruptIndex(t *testing.T) {
+	setupIndexTestEnv(t)
+
+	corrupt, err := encryptIndex(context.Background(), []byte("not a gob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(StoreIndex(), corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateIndex(context.Background(), "hash-b", []string{"prod/other"}); err != nil {
+		t.Fatalf("UpdateIndex failed: %v", err)
+	}
+
+	onDisk, err := readIndex(context.Background())
+	if err != nil {
+		t.Fatalf("readIndex failed: %v", err)
+	}
+	if deps := onDisk["prod/other"]; !deps.Contains("hash-b") {
+		t.Errorf("Expected a new index holding hash-b, got %v", onDisk)
+	}
+}
@@ -0,0 +1,144 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Cache entries are stored as 'user' keys, described by this prefix and
+// their hash, so they can be told apart from other keys in the keyring
+const keyringDescPrefix = "pass-env:"
+
+// Possessor and same user may do everything, nobody else anything
+const keyringPerm = 0x3f3f0000
+
+// keyringBackend keeps entries in a Linux kernel keyring, which the kernel
+// removes once they expire and never writes to disk
+type keyringBackend struct {
+	ring int
+}
+
+// NewKeyringBackend returns a backend that keeps entries in the user or
+// session kernel keyring
+func NewKeyringBackend(ring string) (CacheBackend, error) {
+	switch ring {
+	case KeyringUser:
+		return keyringBackend{ring: unix.KEY_SPEC_USER_KEYRING}, nil
+	case KeyringSession:
+		return keyringBackend{ring: unix.KEY_SPEC_SESSION_KEYRING}, nil
+	}
+	return nil, fmt.Errorf("unknown keyring '%s', expected '%s' or '%s'", ring, KeyringUser, KeyringSession)
+}
+
+func (b keyringBackend) search(hash string) (int, error) {
+	return unix.KeyctlSearch(b.ring, "user", keyringDescPrefix+hash, 0)
+}
+
+func (b keyringBackend) Get(ctx context.Context, hash string) ([]byte, error) {
+	id, err := b.search(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, size)
+	size, err = unix.KeyctlBuffer(unix.KEYCTL_READ, id, buffer, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer[:size], nil
+}
+
+// Set adds or replaces the key for hash. With a ttl the kernel removes the key
+// once it has passed.
+func (b keyringBackend) Set(ctx context.Context, hash string, data []byte, ttl time.Duration) error {
+	id, err := unix.AddKey("user", keyringDescPrefix+hash, data, b.ring)
+	if err != nil {
+		return fmt.Errorf("failed to add key: %s", err)
+	}
+
+	_, err = unix.KeyctlInt(unix.KEYCTL_SETPERM, id, keyringPerm, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to set key permissions: %s", err)
+	}
+
+	if ttl > 0 {
+		seconds := int((ttl + time.Second - 1) / time.Second)
+		_, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, seconds, 0, 0)
+		if err != nil {
+			return fmt.Errorf("failed to set key timeout: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (b keyringBackend) Delete(ctx context.Context, hash string) error {
+	id, err := b.search(hash)
+	if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.EKEYEXPIRED) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+	return err
+}
+
+func (b keyringBackend) List() ([]string, error) {
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, b.ring, nil, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %s", err)
+	}
+
+	buffer := make([]byte, size)
+	size, err = unix.KeyctlBuffer(unix.KEYCTL_READ, b.ring, buffer, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %s", err)
+	}
+
+	var hashes []string
+	for offset := 0; offset+4 <= size; offset += 4 {
+		id := int(*(*int32)(unsafe.Pointer(&buffer[offset])))
+
+		// "type;uid;gid;perm;description"
+		description, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+		if err != nil {
+			continue
+		}
+		fields := strings.SplitN(description, ";", 5)
+		if len(fields) != 5 || fields[0] != "user" || !strings.HasPrefix(fields[4], keyringDescPrefix) {
+			continue
+		}
+		hashes = append(hashes, strings.TrimPrefix(fields[4], keyringDescPrefix))
+	}
+
+	return hashes, nil
+}
+
+// Metadata decodes the entry, since the kernel doesn't record when a key was
+// written
+func (b keyringBackend) Metadata(hash string) (CacheMetadata, error) {
+	data, err := b.Get(context.Background(), hash)
+	if err != nil {
+		return CacheMetadata{}, err
+	}
+
+	entry, err := decodeCacheEntry(data)
+	if err != nil {
+		return CacheMetadata{}, err
+	}
+	return CacheMetadata{Modified: entry.Created, Size: len(data)}, nil
+}
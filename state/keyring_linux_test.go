@@ -0,0 +1,61 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func setupKeyring(t *testing.T) CacheBackend {
+	t.Helper()
+
+	// A fresh session keyring keeps the test away from real entries
+	_, err := unix.KeyctlJoinSessionKeyring(fmt.Sprintf("pass-env-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Skipf("kernel keyring not available: %v", err)
+	}
+
+	backend, err := NewKeyringBackend(KeyringSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestKeyringPermissions(t *testing.T) {
+	backend := setupKeyring(t).(keyringBackend)
+
+	if err := backend.Set(context.Background(), "abc", []byte("data"), 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	id, err := backend.search("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	description, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(description, fmt.Sprintf(";%08x;", keyringPerm)) {
+		t.Errorf("Expected permissions %x, got %s", keyringPerm, description)
+	}
+}
+
+func TestKeyringTimeout(t *testing.T) {
+	backend := setupKeyring(t)
+
+	if err := backend.Set(context.Background(), "abc", []byte("data"), time.Second); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	if _, err := backend.Get(context.Background(), "abc"); err == nil {
+		t.Error("Expected the kernel to have expired the key")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package state
+
+import "errors"
+
+// NewKeyringBackend fails, there is no kernel keyring outside Linux
+func NewKeyringBackend(ring string) (CacheBackend, error) {
+	return nil, errors.New("the kernel keyring cache is only available on Linux")
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package state
+
+import "testing"
+
+func setupKeyring(t *testing.T) CacheBackend {
+	t.Skip("kernel keyring not available outside Linux")
+	return nil
+}
@@ -0,0 +1,56 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestListSecrets(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldPath := Path
+	Path = filepath.Join(tmpDir, "state")
+	defer func() { Path = oldPath }()
+
+	passStore := filepath.Join(tmpDir, "password-store")
+	files := []string{
+		"prod/billing/DATABASE_URL.gpg",
+		"prod/billing/stripe/STRIPE_KEY.gpg",
+		"prod/billing/.hidden/IGNORED.gpg",
+		"prod/billing/README",
+		"prod/other.gpg",
+	}
+	for _, file := range files {
+		p := filepath.Join(passStore, file)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.MkdirAll(Path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(passStore, PassStore()); err != nil {
+		t.Fatal(err)
+	}
+
+	passNames, err := ListSecrets("prod/billing")
+	if err != nil {
+		t.Fatalf("ListSecrets failed: %v", err)
+	}
+
+	slices.Sort(passNames)
+	expected := []string{"prod/billing/DATABASE_URL", "prod/billing/stripe/STRIPE_KEY"}
+	if !slices.Equal(passNames, expected) {
+		t.Errorf("Expected %v, got %v", expected, passNames)
+	}
+
+	_, err = ListSecrets("prod/missing")
+	if err == nil {
+		t.Error("Expected error for missing directory")
+	}
+}
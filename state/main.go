@@ -1,25 +1,21 @@
 package state
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"os"
-	"os/exec"
 	"path"
+	"slices"
 	"strings"
 	"sync"
 
 	"github.com/otard95/pass-env/lib/fs"
-	"github.com/otard95/pass-env/lib/set"
 )
 
-// The cache entries in pass-env's own store that are dependent on pass names
-type passNameDependents map[string]set.Set[string]
-
 var Path string
-var index passNameDependents
 
 func Store() string {
 	return path.Join(Path, "store")
@@ -29,26 +25,33 @@ func PassStore() string {
 	return path.Join(Path, ".pass-store")
 }
 
-func StoreIndex() string {
-	return path.Join(Path, "store.index")
-}
-
 func IsInitialized() bool {
-	return fs.IsDir(Path) && fs.IsDir(Store()) && fs.IsFile(StoreIndex()) && fs.IsLink(PassStore())
+	return fs.IsDir(Path) && fs.IsDir(Store()) &&
+		(fs.IsFile(StoreIndex()) || fs.IsFile(legacyStoreIndex())) &&
+		fs.IsLink(PassStore())
 }
 
-func Init(passStore, gpgKey string) error {
+// Init sets up pass-env's state for passStore. Without a gpgKey, pass-env's
+// own store gets none, and the index is encrypted with the AgeIdentity.
+func Init(ctx context.Context, passStore, gpgKey string) error {
 	err := os.MkdirAll(Path, os.ModeDir|0600)
 	if err != nil {
 		return fmt.Errorf("Failed to create directory '%s': %s", Path, err)
 	}
 
-	passCmd := exec.Command("pass", "init", gpgKey)
-	passCmd.Env = append(passCmd.Env, fmt.Sprintf("PASSWORD_STORE_DIR=%s", Store()))
+	if gpgKey == "" {
+		err = os.MkdirAll(Store(), 0700)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory '%s': %s", Store(), err)
+		}
+	} else {
+		passCmd := commandContext(ctx, "pass", "init", gpgKey)
+		passCmd.Env = append(passCmd.Env, fmt.Sprintf("PASSWORD_STORE_DIR=%s", Store()))
 
-	out, err := passCmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("'pass init' failed: %s\n%s", err, out)
+		out, err := passCmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("'pass init' failed: %s\n%s", err, out)
+		}
 	}
 
 	err = os.Symlink(passStore, PassStore())
@@ -56,7 +59,7 @@ func Init(passStore, gpgKey string) error {
 		return fmt.Errorf("Failed to create link ('%s') to pass store '%s': %s", PassStore(), passStore, err)
 	}
 
-	err = WriteIndex()
+	err = WriteIndex(ctx)
 	if err != nil {
 		return err
 	}
@@ -64,54 +67,29 @@ func Init(passStore, gpgKey string) error {
 	return nil
 }
 
-func WriteIndex() error {
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-
-	err := encoder.Encode(index)
-	if err != nil {
-		return fmt.Errorf("Failed encode index: %s", err)
-	}
-
-	err = os.WriteFile(StoreIndex(), buffer.Bytes(), 0600)
-	if err != nil {
-		return fmt.Errorf("Failed to write index '%s': %s", StoreIndex(), err)
-	}
-
-	return nil
-}
-
-func Index() passNameDependents {
-	return index
-}
-
-func GetDependents(names ...string) []string {
-	result := make(set.Set[string])
-
-	for _, name := range names {
-		if deps, exists := index[name]; exists {
-			result.Merge(deps)
-		}
+func Clear(ctx context.Context, cacheEntries ...string) error {
+	if len(cacheEntries) == 0 {
+		return nil
 	}
 
-	return result.Items()
-}
-
-func Clear(cacheEntries ...string) error {
 	var errors []error
 
 	for _, entry := range cacheEntries {
-		passCmd := exec.Command("pass", "rm", "-f", entry)
-		passCmd.Env = append(os.Environ(), fmt.Sprintf("PASSWORD_STORE_DIR=%s", Store()))
-
-		out, err := passCmd.CombinedOutput()
+		err := cacheBackend.Delete(ctx, entry)
 		if err != nil {
-			if !strings.Contains(string(out), "is not in the password store.") {
-				errors = append(errors, fmt.Errorf("failed to remove '%s': %s\n%s", entry, err, out))
-			}
+			errors = append(errors, fmt.Errorf("failed to remove '%s': %s", entry, err))
 		}
 	}
 
+	err := modifyUsage(func(usage cacheUsage) {
+		for _, entry := range cacheEntries {
+			delete(usage, entry)
+		}
+	})
+	if err != nil {
+		errors = append(errors, fmt.Errorf("failed to update cache usage: %s", err))
+	}
+
 	if len(errors) > 0 {
 		var errMsg string
 		for _, e := range errors {
@@ -123,124 +101,192 @@ func Clear(cacheEntries ...string) error {
 	return nil
 }
 
-func RemoveFromIndex(names ...string) error {
-	for _, name := range names {
-		delete(index, name)
+// GetSecrets fetches secrets from their sources in parallel.
+// Returns a map of NAME -> secret value (first line only).
+func GetSecrets(ctx context.Context, envPairs map[string]string) (map[string]string, error) {
+	fetched, err := FetchSecrets(ctx, envPairs)
+	if err != nil {
+		return nil, err
 	}
 
-	return WriteIndex()
+	secrets := make(map[string]string, len(fetched))
+	for name, secret := range fetched {
+		secrets[name] = secret.Value
+	}
+
+	return secrets, nil
 }
 
-// GetCache retrieves cached environment variables for a given hash.
-// Returns the cached env vars as a map (NAME -> value) and a boolean indicating cache hit.
-func GetCache(hash string) (map[string]string, bool) {
-	passCmd := exec.Command("pass", "show", hash)
-	passCmd.Env = append(os.Environ(), fmt.Sprintf("PASSWORD_STORE_DIR=%s", Store()))
+// FetchConcurrency limits how many secrets are fetched at once, across every
+// fetch running in this process
+var FetchConcurrency = 8
 
-	out, err := passCmd.CombinedOutput()
-	if err != nil {
-		return nil, false
-	}
+var (
+	fetchMu      sync.Mutex
+	fetchDone    = sync.NewCond(&fetchMu)
+	fetchRunning int
+)
 
-	envVars := make(map[string]string)
-	decoder := gob.NewDecoder(bytes.NewBuffer(out))
-	err = decoder.Decode(&envVars)
-	if err != nil {
-		return nil, false
+// resolveLimited is ResolveSecret, waiting first until fewer than
+// FetchConcurrency secrets are being fetched
+func resolveLimited(ctx context.Context, ref string) (Secret, error) {
+	fetchMu.Lock()
+	for fetchRunning >= max(FetchConcurrency, 1) {
+		fetchDone.Wait()
 	}
+	fetchRunning++
+	fetchMu.Unlock()
 
-	return envVars, true
+	defer func() {
+		fetchMu.Lock()
+		fetchRunning--
+		fetchMu.Unlock()
+		fetchDone.Signal()
+	}()
+
+	return ResolveSecret(ctx, ref)
 }
 
-func SetCache(hash string, envVars map[string]string) error {
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	err := encoder.Encode(envVars)
-	if err != nil {
-		return fmt.Errorf("failed to encode cache data: %s", err)
+// FetchSecrets fetches secrets, including their metadata, from their sources.
+// References without a scheme come from the linked pass store. Each reference
+// is fetched once, however many names it is requested under. Fetching stops
+// when ctx is done, with the secrets it didn't get reported as timed out or
+// cancelled. Returns a map of NAME -> secret.
+func FetchSecrets(ctx context.Context, envPairs map[string]string) (map[string]Secret, error) {
+	names := make(map[string][]string)
+	for name, ref := range envPairs {
+		names[ref] = append(names[ref], name)
 	}
 
-	passCmd := exec.Command("pass", "insert", "-m", "-f", hash)
-	passCmd.Env = append(os.Environ(), fmt.Sprintf("PASSWORD_STORE_DIR=%s", Store()))
-	passCmd.Stdin = &buffer
-
-	out, err := passCmd.CombinedOutput()
+	resolved, err := resolveAll(ctx, slices.Sorted(maps.Keys(names)))
 	if err != nil {
-		return fmt.Errorf("failed to store cache entry '%s': %s\n%s", hash, err, out)
+		return nil, err
 	}
 
-	return nil
+	secrets := make(map[string]Secret, len(envPairs))
+	for ref, secret := range resolved {
+		for _, name := range names[ref] {
+			secrets[name] = secret
+		}
+	}
+
+	return secrets, nil
 }
 
-// UpdateIndex adds pass names to the index, mapping them to a cache hash
-func UpdateIndex(hash string, passNames []string) error {
-	if index == nil {
-		index = make(passNameDependents)
-	}
+// resolveAll fetches every ref. The first secret of each unlock key is
+// fetched on its own, so a pinentry prompt it causes unlocks the key for the
+// rest, which are then fetched FetchConcurrency at a time. Every failure is
+// collected into a *FetchError, ordered by ref. If a first fetch was
+// cancelled or timed out, nothing else is fetched. If it found its backend
+// unavailable or its key locked, only the secrets sharing its key are skipped,
+// as they would fail the same way.
+func resolveAll(ctx context.Context, refs []string) (map[string]Secret, error) {
+	resolved := make(map[string]Secret, len(refs))
+	var failed []*SecretError
+
+	keys := make(map[string]string, len(refs))
+	// Every key tried so far, with the failure that left it unusable if any
+	keyFailed := make(map[string]*SecretError)
+	var rest []string
+	for _, ref := range refs {
+		key := unlockKey(ref)
+		keys[ref] = key
+		if _, unlocked := keyFailed[key]; key == "" || unlocked {
+			rest = append(rest, ref)
+			continue
+		}
+		keyFailed[key] = nil
 
-	for _, passName := range passNames {
-		if _, exists := index[passName]; !exists {
-			index[passName] = make(set.Set[string])
+		secret, err := resolveLimited(ctx, ref)
+		if err != nil {
+			secretErr := asSecretError(ref, err)
+			switch secretErr.Kind {
+			case ErrCancelled, ErrTimeout:
+				return nil, &FetchError{Errors: []*SecretError{secretErr}}
+			case ErrUnavailable, ErrUnlockRequired:
+				keyFailed[key] = secretErr
+			}
+			failed = append(failed, secretErr)
+			continue
 		}
-		s := index[passName]
-		s.Add(hash)
-		index[passName] = s
+		resolved[ref] = secret
 	}
 
-	return WriteIndex()
-}
+	rest = slices.DeleteFunc(rest, func(ref string) bool {
+		keyErr := keyFailed[keys[ref]]
+		if keyErr == nil {
+			return false
+		}
+		failed = append(failed, &SecretError{
+			Ref:  ref,
+			Kind: keyErr.Kind,
+			Err:  fmt.Errorf("skipped '%s', its key is the one '%s' failed with: %s", ref, keyErr.Ref, keyErr.Kind),
+		})
+		return true
+	})
 
-// GetSecrets fetches secrets from the parent pass store in parallel.
-// Returns a map of NAME -> secret value (first line only).
-func GetSecrets(envPairs map[string]string) (map[string]string, error) {
 	type result struct {
-		name  string
-		value string
-		err   error
+		secret Secret
+		err    error
 	}
 
-	results := make(chan result, len(envPairs))
+	results := make([]result, len(rest))
+	jobs := make(chan int)
 	var wg sync.WaitGroup
 
-	for name, passName := range envPairs {
+	for range min(max(FetchConcurrency, 1), len(rest)) {
 		wg.Add(1)
-		go func(envName, passPath string) {
+		go func() {
 			defer wg.Done()
-
-			passCmd := exec.Command("pass", "show", passPath)
-			passCmd.Env = append(os.Environ(), fmt.Sprintf("PASSWORD_STORE_DIR=%s", PassStore()))
-
-			out, err := passCmd.CombinedOutput()
-			if err != nil {
-				results <- result{
-					name: envName,
-					err:  fmt.Errorf("secret '%s' not found in password store", passPath),
-				}
-				return
+			for i := range jobs {
+				secret, err := resolveLimited(ctx, rest[i])
+				results[i] = result{secret: secret, err: err}
 			}
-
-			lines := strings.Split(string(out), "\n")
-			secretValue := strings.TrimSpace(lines[0])
-
-			results <- result{
-				name:  envName,
-				value: secretValue,
-			}
-		}(name, passName)
+		}()
 	}
 
+	for i := range rest {
+		jobs <- i
+	}
+	close(jobs)
 	wg.Wait()
-	close(results)
 
-	secrets := make(map[string]string)
-	for res := range results {
-		if res.err != nil {
-			return nil, res.err
+	for i, ref := range rest {
+		if results[i].err != nil {
+			failed = append(failed, asSecretError(ref, results[i].err))
+			continue
 		}
-		secrets[res.name] = res.value
+		resolved[ref] = results[i].secret
 	}
 
-	return secrets, nil
+	if len(failed) > 0 {
+		slices.SortFunc(failed, func(a, b *SecretError) int {
+			return strings.Compare(a.Ref, b.Ref)
+		})
+		return nil, &FetchError{Errors: failed}
+	}
+	return resolved, nil
+}
+
+// Unlock fetches the first secret of each unlock key among refs, one at a
+// time, so that fetching them in parallel afterwards doesn't ask for the same
+// passphrase more than once. Only a cancelled or timed out fetch is an error,
+// other failures are left for the fetch that follows to report.
+func Unlock(ctx context.Context, refs []string) error {
+	tried := make(map[string]bool)
+	for _, ref := range slices.Sorted(slices.Values(refs)) {
+		key := unlockKey(ref)
+		if key == "" || tried[key] {
+			continue
+		}
+		tried[key] = true
+
+		_, err := ResolveSecret(ctx, ref)
+		if errors.Is(err, ErrCancelled) || errors.Is(err, ErrTimeout) {
+			return &FetchError{Errors: []*SecretError{asSecretError(ref, err)}}
+		}
+	}
+	return nil
 }
 
 func IsEnvPair(s string) bool {
@@ -261,18 +307,4 @@ func init() {
 		}
 		Path = path.Join(home, ".local", "share", "pass-env")
 	}
-
-	if IsInitialized() {
-		data, err := os.ReadFile(StoreIndex())
-		if err == nil && len(data) > 0 {
-			decoder := gob.NewDecoder(bytes.NewBuffer(data))
-			err = decoder.Decode(&index)
-			if err != nil {
-				fmt.Printf(
-					"The index file is corrupt, this is not a big issue, you just wont be able to clear cache based on pass-name's\n%s",
-					err,
-				)
-			}
-		}
-	}
 }
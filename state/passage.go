@@ -0,0 +1,280 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/otard95/pass-env/lib/fs"
+	"golang.org/x/term"
+)
+
+// passageSource decrypts the age encrypted entries of a passage(1) store
+// natively, with the identities from passage's identities file
+type passageSource struct {
+	dir func() string
+}
+
+// PassageStore returns the default passage store, $PASSAGE_DIR or
+// ~/.passage/store
+func PassageStore() string {
+	if dir := os.Getenv("PASSAGE_DIR"); dir != "" {
+		return dir
+	}
+	return path.Join(os.Getenv("HOME"), ".passage", "store")
+}
+
+// PassageIdentities returns the file passage reads its identities from,
+// $PASSAGE_IDENTITIES_FILE or ~/.passage/identities
+func PassageIdentities() string {
+	if file := os.Getenv("PASSAGE_IDENTITIES_FILE"); file != "" {
+		return file
+	}
+	return path.Join(os.Getenv("HOME"), ".passage", "identities")
+}
+
+// IsPassageStore reports whether dir is a passage store rather than a pass
+// store: it has no .gpg-id, but age recipients or encrypted entries
+func IsPassageStore(dir string) bool {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	if fs.IsFile(filepath.Join(dir, ".gpg-id")) || !fs.IsDir(dir) {
+		return false
+	}
+	if fs.IsFile(filepath.Join(dir, ".age-recipients")) {
+		return true
+	}
+
+	found := errors.New("found")
+	err = filepath.WalkDir(dir, func(p string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && strings.HasSuffix(entry.Name(), ".age") {
+			return found
+		}
+		return err
+	})
+	return err == found
+}
+
+func (s passageSource) entryFile(name string) string {
+	return filepath.Join(s.dir(), filepath.FromSlash(name)+".age")
+}
+
+func (s passageSource) Resolve(ctx context.Context, name string) (Secret, error) {
+	file, err := os.Open(s.entryFile(name))
+	if err != nil {
+		return Secret{}, secretError(ErrNotFound, "secret '%s' not found in passage store", name)
+	}
+	defer file.Close()
+
+	identities, err := passageIdentities(ctx)
+	if errors.Is(err, ErrUnlockRequired) {
+		return Secret{}, unlockRequired(name)
+	}
+	if err != nil {
+		return Secret{}, err
+	}
+
+	reader, err := age.Decrypt(ageReader(file), identities...)
+	if errors.Is(err, ErrUnlockRequired) {
+		return Secret{}, unlockRequired(name)
+	}
+	if err != nil {
+		return Secret{}, secretError(ErrDecryptFailed, "failed to decrypt '%s': %s", name, err)
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return Secret{}, secretError(ErrDecryptFailed, "failed to decrypt '%s': %s", name, err)
+	}
+
+	return parseEntry(string(content)), nil
+}
+
+func (s passageSource) List(dir string) ([]string, error) {
+	root, err := filepath.EvalSymlinks(s.dir())
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve passage store '%s': %s", s.dir(), err)
+	}
+
+	start := filepath.Join(root, filepath.FromSlash(dir))
+	if !fs.IsDir(start) {
+		return nil, fmt.Errorf("'%s' is not a directory in the passage store", dir)
+	}
+
+	return listFiles(root, start, ".age")
+}
+
+func (s passageSource) Exists(name string) bool {
+	return fs.IsFile(s.entryFile(name))
+}
+
+// UnlockKey is the identities file, every entry is decrypted with the same
+// identities
+func (s passageSource) UnlockKey(name string) string {
+	return "age:" + PassageIdentities()
+}
+
+func (s passageSource) Fingerprint(name string) (string, error) {
+	return fileFingerprint(s.entryFile(name))
+}
+
+// ageReader undoes the ASCII armor of r, if it has any
+func ageReader(r io.Reader) io.Reader {
+	buffered := bufio.NewReader(r)
+	if start, _ := buffered.Peek(len(armor.Header)); string(start) == armor.Header {
+		return armor.NewReader(buffered)
+	}
+	return buffered
+}
+
+var (
+	identitiesOnce  sync.Once
+	identities      []age.Identity
+	identitiesErr   error
+	entryPassphrase *passphraseIdentity
+)
+
+// passageIdentities reads the identities file once per run. It may hold
+// X25519 identities, or be encrypted itself with a passphrase. Entries
+// encrypted with a passphrase rather than to a recipient are decrypted by
+// asking for it too, a prompt that gives up once ctx is done.
+func passageIdentities(ctx context.Context) ([]age.Identity, error) {
+	identitiesOnce.Do(func() {
+		identities, identitiesErr = readIdentities(ctx, PassageIdentities())
+		entryPassphrase = &passphraseIdentity{prompt: "Passphrase for passage entry: "}
+	})
+	return append(slices.Clip(identities), entryPassphrase.bind(ctx)), identitiesErr
+}
+
+func readIdentities(ctx context.Context, file string) ([]age.Identity, error) {
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, secretError(ErrUnavailable, "failed to read age identities: %s", err)
+	}
+
+	if bytes.HasPrefix(content, []byte("age-encryption.org/")) || bytes.HasPrefix(content, []byte(armor.Header)) {
+		passphrase := &passphraseIdentity{prompt: fmt.Sprintf("Passphrase for '%s': ", file)}
+		reader, err := age.Decrypt(ageReader(bytes.NewReader(content)), passphrase.bind(ctx))
+		if errors.Is(err, ErrUnlockRequired) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, secretError(ErrDecryptFailed, "failed to decrypt age identities '%s': %s", file, err)
+		}
+		content, err = io.ReadAll(reader)
+		if err != nil {
+			return nil, secretError(ErrDecryptFailed, "failed to decrypt age identities '%s': %s", file, err)
+		}
+	}
+
+	ids, err := age.ParseIdentities(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse age identities '%s': %s", file, err)
+	}
+	return ids, nil
+}
+
+// passphraseIdentity decrypts files encrypted with a passphrase, which is
+// asked for on the terminal the first time one is met
+type passphraseIdentity struct {
+	prompt string
+
+	mu       sync.Mutex
+	identity *age.ScryptIdentity
+}
+
+// bind returns the identity to decrypt with under ctx, whose prompt gives up
+// once ctx is done
+func (p *passphraseIdentity) bind(ctx context.Context) age.Identity {
+	return boundPassphrase{p, ctx}
+}
+
+type boundPassphrase struct {
+	*passphraseIdentity
+	ctx context.Context
+}
+
+func (b boundPassphrase) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	return b.unwrap(b.ctx, stanzas)
+}
+
+func (p *passphraseIdentity) unwrap(ctx context.Context, stanzas []*age.Stanza) ([]byte, error) {
+	if len(stanzas) != 1 || stanzas[0].Type != "scrypt" {
+		return nil, age.ErrIncorrectIdentity
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.identity == nil {
+		if !Interactive {
+			return nil, secretError(ErrUnlockRequired, "a passphrase is needed, but prompting is off")
+		}
+		passphrase, err := readPassphrase(ctx, p.prompt)
+		if err != nil {
+			return nil, err
+		}
+		p.identity, err = age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p.identity.Unwrap(stanzas)
+}
+
+// readPassphrase asks for a passphrase on the controlling terminal. If ctx is
+// done first, the terminal is restored and ctx's error returned.
+var readPassphrase = func(ctx context.Context, prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", secretError(ErrUnavailable, "a passphrase is needed, but there is no terminal to ask for it: %s", err)
+	}
+	defer tty.Close()
+
+	fd := int(tty.Fd())
+	ttyState, err := term.GetState(fd)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %s", err)
+	}
+
+	type result struct {
+		passphrase []byte
+		err        error
+	}
+	read := make(chan result, 1)
+
+	fmt.Fprint(tty, prompt)
+	go func() {
+		passphrase, err := term.ReadPassword(fd)
+		read <- result{passphrase, err}
+	}()
+
+	select {
+	case r := <-read:
+		fmt.Fprintln(tty)
+		if r.err != nil {
+			return "", fmt.Errorf("failed to read passphrase: %s", r.err)
+		}
+		return string(r.passphrase), nil
+	case <-ctx.Done():
+		term.Restore(fd, ttyState)
+		fmt.Fprintln(tty)
+		return "", ctx.Err()
+	}
+}
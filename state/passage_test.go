@@ -0,0 +1,248 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+func writeAgeFile(t *testing.T, file, content string, armored bool, recipients ...age.Recipient) {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	var dst io.Writer = &buffer
+	var armorWriter io.WriteCloser
+	if armored {
+		armorWriter = armor.NewWriter(&buffer)
+		dst = armorWriter
+	}
+
+	writer, err := age.Encrypt(dst, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if armorWriter != nil {
+		if err := armorWriter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, buffer.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setupPassage creates a passage store with an identity file, and returns the
+// identity's recipient
+func setupPassage(t *testing.T) (string, *age.X25519Recipient) {
+	t.Helper()
+
+	dir := t.TempDir()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identitiesFile := filepath.Join(dir, "identities")
+	if err := os.WriteFile(identitiesFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store := filepath.Join(dir, "store")
+	t.Setenv("PASSAGE_DIR", store)
+	t.Setenv("PASSAGE_IDENTITIES_FILE", identitiesFile)
+
+	identitiesOnce = sync.Once{}
+	t.Cleanup(func() { identitiesOnce = sync.Once{} })
+
+	return store, identity.Recipient()
+}
+
+func TestPassageSource(t *testing.T) {
+	store, recipient := setupPassage(t)
+	writeAgeFile(t, filepath.Join(store, "prod/db.age"), "hunter2\nenv: DB_PASSWORD\n", false, recipient)
+	writeAgeFile(t, filepath.Join(store, "prod/token.age"), "tok\n", true, recipient)
+
+	if !IsPassageStore(store) {
+		t.Error("Expected a passage store")
+	}
+
+	secrets, err := FetchSecrets(context.Background(), map[string]string{
+		"DB":    "passage:prod/db",
+		"TOKEN": "passage:prod/token",
+	})
+	if err != nil {
+		t.Fatalf("FetchSecrets failed: %v", err)
+	}
+	if secrets["DB"].Value != "hunter2" || secrets["DB"].Meta["env"] != "DB_PASSWORD" {
+		t.Errorf("Unexpected secret: %+v", secrets["DB"])
+	}
+	if secrets["TOKEN"].Value != "tok" {
+		t.Errorf("Unexpected armored secret: %+v", secrets["TOKEN"])
+	}
+
+	refs, err := ListSecrets("passage:prod")
+	if err != nil || !slices.Equal(refs, []string{"passage:prod/db", "passage:prod/token"}) {
+		t.Errorf("Unexpected listing: %v %v", refs, err)
+	}
+
+	if _, err := fingerprint("passage:prod/db"); err != nil {
+		t.Errorf("Expected a fingerprint: %v", err)
+	}
+	if SecretExists("passage:prod/missing") {
+		t.Error("Expected missing entry not to exist")
+	}
+}
+
+func TestLinkedPassageStore(t *testing.T) {
+	store, recipient := setupPassage(t)
+	writeAgeFile(t, filepath.Join(store, "prod/db.age"), "hunter2\n", false, recipient)
+
+	oldPath := Path
+	Path = t.TempDir()
+	t.Cleanup(func() { Path = oldPath })
+	if err := os.Symlink(store, PassStore()); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := GetSecrets(context.Background(), map[string]string{"DB": "prod/db"})
+	if err != nil {
+		t.Fatalf("GetSecrets failed: %v", err)
+	}
+	if secrets["DB"] != "hunter2" {
+		t.Errorf("Expected DB=hunter2, got %v", secrets)
+	}
+
+	refs, err := ListSecrets("prod")
+	if err != nil || !slices.Equal(refs, []string{"prod/db"}) {
+		t.Errorf("Unexpected listing: %v %v", refs, err)
+	}
+}
+
+func TestPassagePassphrases(t *testing.T) {
+	store, _ := setupPassage(t)
+
+	oldRead := readPassphrase
+	prompts := 0
+	readPassphrase = func(ctx context.Context, prompt string) (string, error) {
+		prompts++
+		return "correct horse", nil
+	}
+	t.Cleanup(func() { readPassphrase = oldRead })
+
+	// An identities file encrypted with a passphrase, as age -p writes it
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrypt, err := age.NewScryptRecipient("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrypt.SetWorkFactor(10)
+	writeAgeFile(t, os.Getenv("PASSAGE_IDENTITIES_FILE"), identity.String()+"\n", true, scrypt)
+
+	writeAgeFile(t, filepath.Join(store, "db.age"), "hunter2\n", false, identity.Recipient())
+	writeAgeFile(t, filepath.Join(store, "pin.age"), "1234\n", false, scrypt)
+
+	secrets, err := GetSecrets(context.Background(), map[string]string{"DB": "passage:db", "PIN": "passage:pin"})
+	if err != nil {
+		t.Fatalf("GetSecrets failed: %v", err)
+	}
+	if secrets["DB"] != "hunter2" || secrets["PIN"] != "1234" {
+		t.Errorf("Unexpected secrets: %v", secrets)
+	}
+	if prompts != 2 {
+		t.Errorf("Expected a prompt for the identities and one for the entry, got %d", prompts)
+	}
+}
+
+func TestPassageNonInteractive(t *testing.T) {
+	store, recipient := setupPassage(t)
+	Interactive = false
+	t.Cleanup(func() { Interactive = true })
+
+	oldRead := readPassphrase
+	readPassphrase = func(ctx context.Context, prompt string) (string, error) {
+		t.Error("Expected no prompt in non-interactive mode")
+		return "", nil
+	}
+	t.Cleanup(func() { readPassphrase = oldRead })
+
+	scrypt, err := age.NewScryptRecipient("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrypt.SetWorkFactor(10)
+	writeAgeFile(t, filepath.Join(store, "db.age"), "hunter2\n", false, recipient)
+	writeAgeFile(t, filepath.Join(store, "pin.age"), "1234\n", false, scrypt)
+
+	secret, err := ResolveSecret(context.Background(), "passage:db")
+	if err != nil || secret.Value != "hunter2" {
+		t.Errorf("Expected entries for an identity to decrypt without prompting, got %q %v", secret.Value, err)
+	}
+
+	_, err = ResolveSecret(context.Background(), "passage:pin")
+	if !errors.Is(err, ErrUnlockRequired) {
+		t.Errorf("Expected unlock required for a passphrase entry, got %v", err)
+	}
+}
+
+func TestInitWithoutGPG(t *testing.T) {
+	store, recipient := setupPassage(t)
+	writeAgeFile(t, filepath.Join(store, "prod/db.age"), "hunter2\n", false, recipient)
+
+	oldPath, oldIndex, oldIdentity := Path, index, AgeIdentity
+	t.Cleanup(func() { Path, index, AgeIdentity = oldPath, oldIndex, oldIdentity })
+	Path = filepath.Join(t.TempDir(), "state")
+	index = nil
+	AgeIdentity = DefaultAgeIdentity()
+
+	// Neither gpg nor pass may be needed
+	t.Setenv("PATH", "")
+
+	if err := Init(context.Background(), store, ""); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if !IsInitialized() {
+		t.Fatal("Expected pass-env to be initialized")
+	}
+	if !strings.HasSuffix(StoreIndex(), ".age") {
+		t.Errorf("Expected an age encrypted index, got %s", StoreIndex())
+	}
+
+	if err := UpdateIndex(context.Background(), "hash-a", []string{"prod/db"}); err != nil {
+		t.Fatalf("UpdateIndex failed: %v", err)
+	}
+	onDisk, err := readIndex(context.Background())
+	if err != nil {
+		t.Fatalf("readIndex failed: %v", err)
+	}
+	deps := onDisk["prod/db"]
+	if !deps.Contains("hash-a") {
+		t.Errorf("Expected the index to hold hash-a, got %v", onDisk)
+	}
+
+	secrets, err := GetSecrets(context.Background(), map[string]string{"DB": "prod/db"})
+	if err != nil || secrets["DB"] != "hunter2" {
+		t.Errorf("Expected DB=hunter2 from the linked passage store, got %v %v", secrets, err)
+	}
+}
@@ -0,0 +1,99 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// passBackend keeps entries with pass(1) in pass-env's own store, encrypted to
+// the gpg id it was initialized with
+type passBackend struct{}
+
+// NewPassBackend returns a backend that keeps entries in pass-env's own pass
+// store
+func NewPassBackend() CacheBackend {
+	return passBackend{}
+}
+
+func (passBackend) entryFile(hash string) string {
+	return filepath.Join(Store(), filepath.FromSlash(hash)+".gpg")
+}
+
+func (b passBackend) Get(ctx context.Context, hash string) ([]byte, error) {
+	if file := b.entryFile(hash); canDecryptDirectly(file) {
+		return decryptFile(ctx, file)
+	}
+
+	passCmd := commandContext(ctx, "pass", "show", hash)
+	passCmd.Env = passEnv(Store())
+
+	out, err := passCmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (passBackend) Set(ctx context.Context, hash string, data []byte, ttl time.Duration) error {
+	passCmd := commandContext(ctx, "pass", "insert", "-m", "-f", hash)
+	passCmd.Env = passEnv(Store())
+	passCmd.Stdin = bytes.NewReader(data)
+
+	out, err := passCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s\n%s", err, out)
+	}
+
+	return nil
+}
+
+func (passBackend) Delete(ctx context.Context, hash string) error {
+	passCmd := commandContext(ctx, "pass", "rm", "-f", hash)
+	passCmd.Env = passEnv(Store())
+
+	out, err := passCmd.CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "is not in the password store.") {
+		return fmt.Errorf("%s\n%s", err, out)
+	}
+
+	return nil
+}
+
+func (passBackend) List() ([]string, error) {
+	var hashes []string
+
+	err := filepath.WalkDir(Store(), func(p string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".gpg") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(Store(), p)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, strings.TrimSuffix(filepath.ToSlash(rel), ".gpg"))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache entries in '%s': %s", Store(), err)
+	}
+
+	return hashes, nil
+}
+
+func (b passBackend) Metadata(hash string) (CacheMetadata, error) {
+	stat, err := os.Stat(b.entryFile(hash))
+	if err != nil {
+		return CacheMetadata{}, err
+	}
+	return CacheMetadata{Modified: stat.ModTime(), Size: int(stat.Size())}, nil
+}
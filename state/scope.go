@@ -0,0 +1,107 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CacheScope is how long a cache entry may outlive the circumstances it was
+// written in
+type CacheScope string
+
+const (
+	// The entry survives reboots and logouts, until it expires or is cleared
+	ScopePersistent CacheScope = "persistent"
+	// The entry is a miss after the machine reboots
+	ScopeBoot CacheScope = "boot"
+	// The entry is a miss after a reboot or outside the login session that
+	// wrote it
+	ScopeSession CacheScope = "session"
+)
+
+// The audit session id of processes outside any login session
+const unsetSessionID = "4294967295"
+
+func ParseCacheScope(s string) (CacheScope, error) {
+	switch scope := CacheScope(strings.ToLower(s)); scope {
+	case ScopePersistent, ScopeBoot, ScopeSession:
+		return scope, nil
+	case "":
+		return ScopePersistent, nil
+	}
+	return "", fmt.Errorf("unknown cache scope '%s', expected persistent, boot or session", s)
+}
+
+// BootID returns the kernel's id for the current boot, or an empty string if
+// it isn't available
+func BootID() string {
+	id, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
+
+// SessionID returns the id of the current login session, or an empty string
+// if it isn't known. The kernel's audit session id is preferred, since the
+// environment can be changed by anyone.
+func SessionID() string {
+	id, err := os.ReadFile("/proc/self/sessionid")
+	if err == nil {
+		if id := strings.TrimSpace(string(id)); id != "" && id != unsetSessionID {
+			return "audit:" + id
+		}
+	}
+	if id := os.Getenv("XDG_SESSION_ID"); id != "" {
+		return "xdg:" + id
+	}
+	return ""
+}
+
+// BindTo ties the entry to the current boot, and login session, as scope
+// requires. Fails if the ids scope needs aren't available, rather than
+// silently writing an entry that outlives them.
+func (e *CacheEntry) BindTo(scope CacheScope) error {
+	e.BootID, e.SessionID = "", ""
+	if scope == ScopePersistent {
+		return nil
+	}
+
+	e.BootID = BootID()
+	if e.BootID == "" {
+		return fmt.Errorf("can't bind cache entry to this boot, the boot id is unavailable")
+	}
+
+	if scope == ScopeSession {
+		e.SessionID = SessionID()
+		if e.SessionID == "" {
+			return fmt.Errorf("can't bind cache entry to this session, the session id is unavailable")
+		}
+	}
+
+	return nil
+}
+
+// Scope returns the scope the entry was bound to when it was written
+func (e *CacheEntry) Scope() CacheScope {
+	switch {
+	case e.SessionID != "":
+		return ScopeSession
+	case e.BootID != "":
+		return ScopeBoot
+	}
+	return ScopePersistent
+}
+
+// InScope reports whether the entry is bound to the current boot and login
+// session, or isn't bound at all
+func (e *CacheEntry) InScope() bool {
+	if e.BootID != "" && e.BootID != BootID() {
+		return false
+	}
+	if e.SessionID != "" && e.SessionID != SessionID() {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package state
+
+import "testing"
+
+func TestCacheEntryScope(t *testing.T) {
+	if BootID() == "" {
+		t.Skip("No boot id available")
+	}
+
+	entry := &CacheEntry{}
+	if err := entry.BindTo(ScopeBoot); err != nil {
+		t.Fatalf("BindTo failed: %v", err)
+	}
+	if entry.Scope() != ScopeBoot || !entry.InScope() {
+		t.Errorf("Expected an in scope boot entry, got %s (in scope: %v)", entry.Scope(), entry.InScope())
+	}
+
+	entry.BootID = "another-boot"
+	if entry.InScope() {
+		t.Error("Expected an entry from another boot to be out of scope")
+	}
+
+	if err := entry.BindTo(ScopePersistent); err != nil {
+		t.Fatalf("BindTo failed: %v", err)
+	}
+	if entry.Scope() != ScopePersistent || !entry.InScope() {
+		t.Error("Expected a persistent entry to always be in scope")
+	}
+}
+
+func TestCacheEntrySessionScope(t *testing.T) {
+	if BootID() == "" {
+		t.Skip("No boot id available")
+	}
+	t.Setenv("XDG_SESSION_ID", "1")
+
+	entry := &CacheEntry{}
+	if err := entry.BindTo(ScopeSession); err != nil {
+		t.Fatalf("BindTo failed: %v", err)
+	}
+	if !entry.InScope() {
+		t.Error("Expected the entry to be in scope in its own session")
+	}
+
+	entry.SessionID = "xdg:another-session"
+	if entry.InScope() {
+		t.Error("Expected an entry from another session to be out of scope")
+	}
+}
+
+func TestParseCacheScope(t *testing.T) {
+	for input, expected := range map[string]CacheScope{
+		"":        ScopePersistent,
+		"boot":    ScopeBoot,
+		"Session": ScopeSession,
+	} {
+		scope, err := ParseCacheScope(input)
+		if err != nil || scope != expected {
+			t.Errorf("ParseCacheScope(%q): expected %s, got %s (%v)", input, expected, scope, err)
+		}
+	}
+
+	if _, err := ParseCacheScope("forever"); err == nil {
+		t.Error("Expected an unknown scope to be rejected")
+	}
+}
@@ -0,0 +1,160 @@
+package state
+
+import (
+	"context"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/otard95/pass-env/lib/set"
+)
+
+// CacheSelector picks cache entries. Entries matching any of PassNames,
+// Hashes or Vars are selected, or every entry with All. OlderThan then
+// narrows the selection down, or applies to every entry if nothing else is
+// given.
+type CacheSelector struct {
+	// Pass names, globs like 'prod/*' or prefixes like 'prod/'
+	PassNames []string
+	Hashes    []string
+	// Variable names the entry sets
+	Vars      []string
+	OlderThan time.Duration
+	All       bool
+}
+
+// CacheSelection is a selected cache entry and the pass names linked to it
+type CacheSelection struct {
+	Hash      string
+	PassNames []string
+}
+
+// SelectCache returns the cache entries picked by sel, sorted by hash.
+// Selecting by variable name or age decrypts every candidate entry.
+func SelectCache(ctx context.Context, sel CacheSelector) ([]CacheSelection, error) {
+	hashes, err := ListCache()
+	if err != nil {
+		return nil, err
+	}
+	stored := make(set.Set[string])
+	for _, hash := range hashes {
+		stored.Add(hash)
+	}
+
+	linkedNames := make(map[string][]string)
+	for passName, deps := range loadIndex(ctx) {
+		for hash := range deps {
+			linkedNames[hash] = append(linkedNames[hash], passName)
+		}
+	}
+
+	selectAll := sel.selectsAll()
+
+	var selected []CacheSelection
+	for _, hash := range hashes {
+		var entry *CacheEntry
+		matched := selectAll ||
+			slices.Contains(sel.Hashes, hash) ||
+			slices.ContainsFunc(linkedNames[hash], func(passName string) bool {
+				return slices.ContainsFunc(sel.PassNames, func(pattern string) bool {
+					return MatchPassName(pattern, passName)
+				})
+			})
+		if !matched && len(sel.Vars) > 0 {
+			entry, _ = ReadCacheEntry(ctx, hash)
+			matched = entry != nil && slices.ContainsFunc(sel.Vars, func(name string) bool {
+				_, sets := entry.Values[name]
+				return sets
+			})
+		}
+		if !matched {
+			continue
+		}
+
+		if sel.OlderThan > 0 {
+			if entry == nil {
+				entry, _ = ReadCacheEntry(ctx, hash)
+			}
+			if !isOlderThan(hash, entry, sel.OlderThan) {
+				continue
+			}
+		}
+
+		passNames := linkedNames[hash]
+		slices.Sort(passNames)
+		selected = append(selected, CacheSelection{Hash: hash, PassNames: passNames})
+	}
+
+	return selected, nil
+}
+
+// Matches reports whether sel picks entry, held under hash, going by the pass
+// names, variables and creation time the entry itself records
+func (sel CacheSelector) Matches(hash string, entry *CacheEntry) bool {
+	matched := sel.selectsAll() ||
+		slices.Contains(sel.Hashes, hash) ||
+		slices.ContainsFunc(entry.PassNames, func(passName string) bool {
+			return slices.ContainsFunc(sel.PassNames, func(pattern string) bool {
+				return MatchPassName(pattern, passName)
+			})
+		}) ||
+		slices.ContainsFunc(sel.Vars, func(name string) bool {
+			_, sets := entry.Values[name]
+			return sets
+		})
+
+	return matched && (sel.OlderThan <= 0 || time.Since(entry.Created) > sel.OlderThan)
+}
+
+func (sel CacheSelector) selectsAll() bool {
+	return sel.All || (len(sel.PassNames) == 0 && len(sel.Hashes) == 0 && len(sel.Vars) == 0)
+}
+
+// isOlderThan reports whether the entry was created more than age ago. Legacy
+// and unreadable entries fall back to when the backend last wrote them.
+func isOlderThan(hash string, entry *CacheEntry, age time.Duration) bool {
+	created := time.Time{}
+	if entry != nil {
+		created = entry.Created
+	}
+	if created.IsZero() {
+		meta, err := cacheBackend.Metadata(hash)
+		if err != nil {
+			return false
+		}
+		created = meta.Modified
+	}
+	return time.Since(created) > age
+}
+
+// MatchPassName reports whether passName matches pattern. A pattern ending in
+// '/' matches everything under it, other patterns are globs that also match
+// everything under the directories they match, so 'prod/*' matches
+// 'prod/billing/key'.
+func MatchPassName(pattern, passName string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(passName, pattern)
+	}
+
+	for candidate := passName; candidate != "." && candidate != "/"; candidate = path.Dir(candidate) {
+		if matched, _ := path.Match(pattern, candidate); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveHashesFromIndex removes every index link to the given cache entries
+func RemoveHashesFromIndex(ctx context.Context, hashes ...string) error {
+	return modifyIndex(ctx, func(deps passNameDependents) {
+		for passName, linked := range deps {
+			for _, hash := range hashes {
+				linked.Remove(hash)
+			}
+			if len(linked) == 0 {
+				delete(deps, passName)
+			}
+		}
+	})
+}
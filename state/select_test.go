@@ -0,0 +1,61 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchPassName(t *testing.T) {
+	cases := []struct {
+		pattern  string
+		passName string
+		expected bool
+	}{
+		{"prod/db", "prod/db", true},
+		{"prod/db", "prod/db2", false},
+		{"prod/*", "prod/db", true},
+		{"prod/*", "prod/billing/stripe", true},
+		{"prod/*", "staging/db", false},
+		{"prod/", "prod/billing/stripe", true},
+		{"prod/", "production/db", false},
+		{"prod", "prod/db", true},
+		{"*/token", "github/token", true},
+		{"*/token", "github/token/old", true},
+		{"*/token", "token", false},
+	}
+
+	for _, c := range cases {
+		if actual := MatchPassName(c.pattern, c.passName); actual != c.expected {
+			t.Errorf("MatchPassName(%q, %q): expected %v, got %v", c.pattern, c.passName, c.expected, actual)
+		}
+	}
+}
+
+func TestCacheSelectorMatches(t *testing.T) {
+	entry := &CacheEntry{
+		Created:   time.Now().Add(-time.Hour),
+		PassNames: []string{"prod/db"},
+		Values:    map[string]string{"DB_URL": "postgres://"},
+	}
+
+	cases := []struct {
+		name     string
+		sel      CacheSelector
+		expected bool
+	}{
+		{"nothing selects all", CacheSelector{}, true},
+		{"pass name", CacheSelector{PassNames: []string{"prod/*"}}, true},
+		{"other pass name", CacheSelector{PassNames: []string{"staging/"}}, false},
+		{"hash", CacheSelector{Hashes: []string{"abc"}}, true},
+		{"var", CacheSelector{Vars: []string{"DB_URL"}}, true},
+		{"other var", CacheSelector{Vars: []string{"TOKEN"}}, false},
+		{"older than", CacheSelector{OlderThan: time.Minute}, true},
+		{"not older than", CacheSelector{All: true, OlderThan: 2 * time.Hour}, false},
+	}
+
+	for _, c := range cases {
+		if actual := c.sel.Matches("abc", entry); actual != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, actual)
+		}
+	}
+}
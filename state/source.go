@@ -0,0 +1,369 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/otard95/pass-env/lib/fs"
+	"golang.org/x/term"
+)
+
+// SecretSource is somewhere secrets are fetched from, by a reference that
+// means something to it, e.g. a pass name or a file path
+type SecretSource interface {
+	// Resolve fetches the secret ref refers to. Its first line is the value,
+	// the rest metadata, as in a pass entry. It gives up once ctx is done.
+	Resolve(ctx context.Context, ref string) (Secret, error)
+	// List returns the references of every secret under dir
+	List(dir string) ([]string, error)
+	Exists(ref string) bool
+}
+
+// The scheme of references without one
+const defaultScheme = "pass"
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = map[string]SecretSource{
+		"pass":    passSource{},
+		"passage": passageSource{dir: PassageStore},
+		"file":    fileSource{},
+		"cmd":     cmdSource{},
+	}
+)
+
+// fingerprinter is a source that can tell a secret changed without
+// decrypting it
+type fingerprinter interface {
+	Fingerprint(ref string) (string, error)
+}
+
+// unlocker is a source whose secrets are encrypted to keys that may have to
+// be unlocked, e.g. by a passphrase prompt
+type unlocker interface {
+	// UnlockKey identifies the key ref is encrypted to. Secrets sharing a key
+	// are unlocked together, "" means ref needs no unlocking.
+	UnlockKey(ref string) string
+}
+
+// unlockKey returns the key the secret ref refers to is encrypted to, or ""
+// if its source has none
+func unlockKey(ref string) string {
+	source, name := sourceOf(ref)
+	if unlocker, ok := source.(unlocker); ok {
+		return unlocker.UnlockKey(name)
+	}
+	return ""
+}
+
+// RegisterSource makes source available to references of the form
+// SCHEME:REF, replacing any source already registered for scheme
+func RegisterSource(scheme string, source SecretSource) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	sources[scheme] = source
+}
+
+// SplitRef splits a reference into its scheme and the reference within that
+// scheme's source. References without a registered scheme belong to the pass
+// store, so pass names containing a ':' keep working.
+func SplitRef(ref string) (scheme, name string) {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+
+	if scheme, name, found := strings.Cut(ref, ":"); found {
+		if _, exists := sources[scheme]; exists {
+			return scheme, name
+		}
+	}
+	return defaultScheme, ref
+}
+
+// sourceOf returns the source ref belongs to, and the reference within it
+func sourceOf(ref string) (SecretSource, string) {
+	scheme, name := SplitRef(ref)
+
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	return sources[scheme], name
+}
+
+// ResolveSecret fetches the secret ref refers to from its source. Failures are
+// returned as a *SecretError, one of kind ErrTimeout or ErrCancelled if ctx
+// ended the fetch.
+func ResolveSecret(ctx context.Context, ref string) (Secret, error) {
+	if ctx.Err() != nil {
+		return Secret{}, contextError(ctx, ref)
+	}
+
+	source, name := sourceOf(ref)
+	secret, err := source.Resolve(ctx, name)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Secret{}, contextError(ctx, ref)
+		}
+		return Secret{}, asSecretError(ref, err)
+	}
+	return secret, nil
+}
+
+// How long a cancelled command has to exit after SIGTERM before it is killed
+const cancelGrace = 2 * time.Second
+
+// commandContext is exec.CommandContext, except that a command ctx cancels
+// gets SIGTERM first, so gpg can tell its agent to close pinentry. The command
+// runs in a process group of its own, and the whole group is signalled, so
+// e.g. the gpg that pass(1) starts is stopped along with it.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		if cmd.SysProcAttr.Setpgid {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		}
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = cancelGrace
+	return cmd
+}
+
+// SecretExists reports whether the secret ref refers to exists in its source
+func SecretExists(ref string) bool {
+	source, name := sourceOf(ref)
+	return source.Exists(name)
+}
+
+// ListSecrets returns the references of every secret under dir, which may
+// itself have a scheme prefix that the returned references then share
+func ListSecrets(dir string) ([]string, error) {
+	scheme, _ := SplitRef(dir)
+	source, name := sourceOf(dir)
+
+	refs, err := source.List(name)
+	if err != nil {
+		return nil, err
+	}
+	if scheme != defaultScheme || strings.HasPrefix(dir, defaultScheme+":") {
+		for i, ref := range refs {
+			refs[i] = scheme + ":" + ref
+		}
+	}
+
+	slices.Sort(refs)
+	return refs, nil
+}
+
+// passSource fetches secrets from the linked pass store, decrypting them with
+// gpg directly where it can and with pass(1) otherwise, or natively if the
+// linked store is a passage store
+type passSource struct{}
+
+// linkedPassage returns a source for the linked store if it is a passage store
+func linkedPassage() (passageSource, bool) {
+	return passageSource{dir: PassStore}, IsPassageStore(PassStore())
+}
+
+func (passSource) Resolve(ctx context.Context, passName string) (Secret, error) {
+	if passage, ok := linkedPassage(); ok {
+		return passage.Resolve(ctx, passName)
+	}
+
+	file := filepath.Join(PassStore(), filepath.FromSlash(passName)+".gpg")
+	if canDecryptDirectly(file) {
+		out, err := decryptFile(ctx, file)
+		if errors.Is(err, ErrUnlockRequired) {
+			return Secret{}, unlockRequired(passName)
+		}
+		if err != nil {
+			return Secret{}, fmt.Errorf("failed to decrypt '%s': %w", passName, err)
+		}
+		return parseEntry(string(out)), nil
+	}
+
+	passCmd := commandContext(ctx, "pass", "show", passName)
+	passCmd.Env = passEnv(PassStore())
+
+	out, err := passCmd.CombinedOutput()
+	if err != nil {
+		kind := gpgErrorKind(err, string(out))
+		switch kind {
+		case ErrNotFound:
+			return Secret{}, secretError(kind, "secret '%s' not found in password store", passName)
+		case ErrUnlockRequired:
+			return Secret{}, unlockRequired(passName)
+		}
+		return Secret{}, secretError(kind, "'pass show %s' failed: %s\n%s", passName, err, strings.TrimSpace(string(out)))
+	}
+
+	return parseEntry(string(out)), nil
+}
+
+func (passSource) List(dir string) ([]string, error) {
+	if passage, ok := linkedPassage(); ok {
+		return passage.List(dir)
+	}
+
+	root, err := filepath.EvalSymlinks(PassStore())
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve pass store '%s': %s", PassStore(), err)
+	}
+
+	start := filepath.Join(root, filepath.FromSlash(dir))
+	if !fs.IsDir(start) {
+		return nil, fmt.Errorf("'%s' is not a directory in the password store", dir)
+	}
+
+	return listFiles(root, start, ".gpg")
+}
+
+func (passSource) Exists(passName string) bool {
+	if passage, ok := linkedPassage(); ok {
+		return passage.Exists(passName)
+	}
+	return fs.IsFile(filepath.Join(PassStore(), filepath.FromSlash(passName)+".gpg"))
+}
+
+func (passSource) Fingerprint(passName string) (string, error) {
+	if passage, ok := linkedPassage(); ok {
+		return passage.Fingerprint(passName)
+	}
+	return fileFingerprint(filepath.Join(PassStore(), filepath.FromSlash(passName)+".gpg"))
+}
+
+// UnlockKey is the gpg ids in the .gpg-id nearest to passName, as pass(1)
+// encrypts to those
+func (passSource) UnlockKey(passName string) string {
+	if passage, ok := linkedPassage(); ok {
+		return passage.UnlockKey(passName)
+	}
+
+	root := filepath.Clean(PassStore())
+	dir := filepath.Dir(filepath.Join(root, filepath.FromSlash(passName)))
+	for strings.HasPrefix(dir, root) {
+		content, err := os.ReadFile(filepath.Join(dir, ".gpg-id"))
+		if err == nil {
+			return "gpg:" + strings.Join(strings.Fields(string(content)), ",")
+		}
+		dir = filepath.Dir(dir)
+	}
+	return "gpg:"
+}
+
+// fileSource reads secrets from plain files, e.g. ones mounted by a container
+// runtime in /run/secrets
+type fileSource struct{}
+
+func (fileSource) Resolve(ctx context.Context, path string) (Secret, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Secret{}, secretError(ErrNotFound, "secret file '%s' not found", path)
+	}
+	if err != nil {
+		return Secret{}, fmt.Errorf("secret file '%s' could not be read: %s", path, err)
+	}
+
+	return parseEntry(string(content)), nil
+}
+
+func (fileSource) List(dir string) ([]string, error) {
+	if !fs.IsDir(dir) {
+		return nil, fmt.Errorf("'%s' is not a directory", dir)
+	}
+
+	files, err := listFiles(dir, dir, "")
+	if err != nil {
+		return nil, err
+	}
+	for i, file := range files {
+		files[i] = filepath.Join(dir, file)
+	}
+	return files, nil
+}
+
+func (fileSource) Exists(path string) bool {
+	return fs.IsFile(path)
+}
+
+// cmdSource runs a shell command and takes the secret from its output, e.g.
+// 'cmd:op read op://vault/item/password'
+type cmdSource struct{}
+
+func (cmdSource) Resolve(ctx context.Context, command string) (Secret, error) {
+	shCmd := commandContext(ctx, "sh", "-c", command)
+	if Interactive {
+		shCmd.Stdin = os.Stdin
+		// Only the foreground process group may read the terminal, so a
+		// command that prompts on it has to stay in pass-env's
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			shCmd.SysProcAttr.Setpgid = false
+		}
+	}
+	shCmd.Stderr = os.Stderr
+
+	out, err := shCmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 127 {
+		return Secret{}, secretError(ErrUnavailable, "secret command '%s' failed: %s", command, err)
+	}
+	if err != nil {
+		return Secret{}, fmt.Errorf("secret command '%s' failed: %s", command, err)
+	}
+
+	return parseEntry(string(out)), nil
+}
+
+func (cmdSource) List(dir string) ([]string, error) {
+	return nil, fmt.Errorf("secret commands can't be listed")
+}
+
+// Exists reports whether the command's program can be found, since whether
+// it produces a secret is only known by running it
+func (cmdSource) Exists(command string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return false
+	}
+	_, err := exec.LookPath(fields[0])
+	return err == nil
+}
+
+// listFiles returns the slash separated paths, relative to root, of the files
+// under start ending in suffix, without the suffix. Hidden files and
+// directories are skipped.
+func listFiles(root, start, suffix string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(start, func(p string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != start && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), suffix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, strings.TrimSuffix(filepath.ToSlash(rel), suffix))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list '%s': %s", start, err)
+	}
+
+	return files, nil
+}
@@ -0,0 +1,210 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSource serves secrets from a map, failing the refs in fail with their
+// kind, and records how it is called. Its secrets share the unlock key key,
+// if it has one.
+type testSource struct {
+	secrets map[string]string
+	fail    map[string]ErrorKind
+	key     string
+	delay   time.Duration
+
+	mu       sync.Mutex
+	calls    map[string]int
+	running  int
+	peak     int
+	firstRan bool
+	// Whether a resolve started while the first one was still running
+	overlap bool
+}
+
+func (s *testSource) Resolve(ctx context.Context, ref string) (Secret, error) {
+	s.mu.Lock()
+	if s.calls == nil {
+		s.calls = make(map[string]int)
+	}
+	s.calls[ref]++
+	s.running++
+	s.peak = max(s.peak, s.running)
+	if !s.firstRan && s.running > 1 {
+		s.overlap = true
+	}
+	s.mu.Unlock()
+
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	s.running--
+	s.firstRan = true
+	s.mu.Unlock()
+
+	if kind, fails := s.fail[ref]; fails {
+		return Secret{}, secretError(kind, "%s failed", ref)
+	}
+	value, exists := s.secrets[ref]
+	if !exists {
+		return Secret{}, errors.New("not found")
+	}
+	return parseEntry(value), nil
+}
+
+func (s *testSource) List(dir string) ([]string, error) {
+	var refs []string
+	for ref := range s.secrets {
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+func (s *testSource) Exists(ref string) bool {
+	_, exists := s.secrets[ref]
+	return exists
+}
+
+func (s *testSource) UnlockKey(ref string) string {
+	return s.key
+}
+
+// totalCalls returns how many resolves there were
+func (s *testSource) totalCalls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	for _, calls := range s.calls {
+		total += calls
+	}
+	return total
+}
+
+// registerTestSource makes source available under scheme until the test ends
+func registerTestSource(t *testing.T, scheme string, source SecretSource) {
+	RegisterSource(scheme, source)
+	t.Cleanup(func() {
+		sourcesMu.Lock()
+		delete(sources, scheme)
+		sourcesMu.Unlock()
+	})
+}
+
+func TestSplitRef(t *testing.T) {
+	cases := []struct {
+		ref, scheme, name string
+	}{
+		{"github/token", "pass", "github/token"},
+		{"pass:github/token", "pass", "github/token"},
+		{"file:/run/secrets/db", "file", "/run/secrets/db"},
+		{"cmd:echo hi", "cmd", "echo hi"},
+		{"weird:name", "pass", "weird:name"},
+	}
+
+	for _, c := range cases {
+		scheme, name := SplitRef(c.ref)
+		if scheme != c.scheme || name != c.name {
+			t.Errorf("SplitRef(%q): expected %s/%s, got %s/%s", c.ref, c.scheme, c.name, scheme, name)
+		}
+	}
+}
+
+func TestFileAndCmdSources(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "db")
+	if err := os.WriteFile(secretFile, []byte("hunter2\nenv: DB_PASSWORD\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".hidden"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := FetchSecrets(context.Background(), map[string]string{
+		"DB":    "file:" + secretFile,
+		"TOKEN": "cmd:printf 'tok\\ncache: never\\n'",
+	})
+	if err != nil {
+		t.Fatalf("FetchSecrets failed: %v", err)
+	}
+	if secrets["DB"].Value != "hunter2" || secrets["DB"].Meta["env"] != "DB_PASSWORD" {
+		t.Errorf("Unexpected file secret: %+v", secrets["DB"])
+	}
+	if secrets["TOKEN"].Value != "tok" || !secrets["TOKEN"].NeverCache() {
+		t.Errorf("Unexpected command secret: %+v", secrets["TOKEN"])
+	}
+
+	if _, err := FetchSecrets(context.Background(), map[string]string{"X": "cmd:exit 1"}); err == nil {
+		t.Error("Expected a failing command to fail the fetch")
+	}
+
+	refs, err := ListSecrets("file:" + dir)
+	if err != nil {
+		t.Fatalf("ListSecrets failed: %v", err)
+	}
+	if !slices.Equal(refs, []string{"file:" + secretFile}) {
+		t.Errorf("Expected only the db file, got %v", refs)
+	}
+
+	if !SecretExists("file:"+secretFile) || SecretExists("file:"+filepath.Join(dir, "missing")) {
+		t.Error("Unexpected file existence")
+	}
+	if !SecretExists("cmd:sh -c true") || SecretExists("cmd:no-such-program-here") {
+		t.Error("Unexpected command existence")
+	}
+}
+
+func TestRegisterSource(t *testing.T) {
+	registerTestSource(t, "fake", &testSource{secrets: map[string]string{"token": "secret"}})
+
+	secrets, err := GetSecrets(context.Background(), map[string]string{"TOKEN": "fake:token"})
+	if err != nil {
+		t.Fatalf("GetSecrets failed: %v", err)
+	}
+	if secrets["TOKEN"] != "secret" {
+		t.Errorf("Expected TOKEN=secret, got %v", secrets)
+	}
+
+	refs, err := ListSecrets("fake:")
+	if err != nil || !slices.Equal(refs, []string{"fake:token"}) {
+		t.Errorf("Expected [fake:token], got %v %v", refs, err)
+	}
+}
+
+func TestPassUnlockKey(t *testing.T) {
+	oldPath := Path
+	Path = t.TempDir()
+	t.Cleanup(func() { Path = oldPath })
+
+	for file, content := range map[string]string{
+		".gpg-id":      "me@example.com\n",
+		"work/.gpg-id": "work@example.com\nme@example.com\n",
+	} {
+		file = filepath.Join(PassStore(), file)
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]string{
+		"token":        "gpg:me@example.com",
+		"prod/db":      "gpg:me@example.com",
+		"work/db":      "gpg:work@example.com,me@example.com",
+		"work/team/db": "gpg:work@example.com,me@example.com",
+	}
+	for passName, want := range tests {
+		if got := unlockKey(passName); got != want {
+			t.Errorf("unlockKey(%q) = %q, want %q", passName, got, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package state
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/otard95/pass-env/lib/fs"
+)
+
+// When each cache entry was last used. Kept apart from the entries so a
+// cache hit doesn't have to re-encrypt anything, it holds nothing but hashes.
+type cacheUsage map[string]time.Time
+
+func storeUsage() string {
+	return path.Join(Path, "store.usage")
+}
+
+func readUsage() (cacheUsage, error) {
+	usage := make(cacheUsage)
+
+	data, err := os.ReadFile(storeUsage())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return usage, nil
+		}
+		return nil, fmt.Errorf("failed to read '%s': %s", storeUsage(), err)
+	}
+	if len(data) == 0 {
+		return usage, nil
+	}
+
+	decoder := gob.NewDecoder(bytes.NewBuffer(data))
+	err = decoder.Decode(&usage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode '%s': %s", storeUsage(), err)
+	}
+
+	return usage, nil
+}
+
+func modifyUsage(modify func(cacheUsage)) error {
+	unlock, err := fs.Lock(storeLock())
+	if err != nil {
+		return fmt.Errorf("failed to lock '%s': %s", storeLock(), err)
+	}
+	defer unlock()
+
+	usage, err := readUsage()
+	if err != nil {
+		usage = make(cacheUsage)
+	}
+
+	modify(usage)
+
+	var buffer bytes.Buffer
+	err = gob.NewEncoder(&buffer).Encode(usage)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache usage: %s", err)
+	}
+
+	return fs.WriteFileAtomic(storeUsage(), buffer.Bytes(), 0600)
+}
+
+// TouchCache records that the cache entry for hash was just used, if the
+// cache persists
+func TouchCache(hash string) error {
+	if !CachePersists() {
+		return nil
+	}
+
+	return modifyUsage(func(usage cacheUsage) {
+		usage[hash] = time.Now()
+	})
+}
+
+// LastUsed returns when the cache entry for hash was last used, and whether
+// that is known at all
+func LastUsed(hash string) (time.Time, bool) {
+	usage, err := readUsage()
+	if err != nil {
+		return time.Time{}, false
+	}
+	lastUsed, found := usage[hash]
+	return lastUsed, found
+}
@@ -0,0 +1,29 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTouchCache(t *testing.T) {
+	oldPath := Path
+	Path = t.TempDir()
+	defer func() { Path = oldPath }()
+
+	if _, found := LastUsed("hash-a"); found {
+		t.Error("Expected no last use before the entry was touched")
+	}
+
+	before := time.Now()
+	if err := TouchCache("hash-a"); err != nil {
+		t.Fatalf("TouchCache failed: %v", err)
+	}
+
+	lastUsed, found := LastUsed("hash-a")
+	if !found {
+		t.Fatal("Expected a last use after the entry was touched")
+	}
+	if lastUsed.Before(before) {
+		t.Errorf("Expected last use after %v, got %v", before, lastUsed)
+	}
+}